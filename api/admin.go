@@ -0,0 +1,176 @@
+package api
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/nanopack/logvac/authenticator"
+	"github.com/nanopack/logvac/config"
+	"github.com/nanopack/logvac/drain"
+)
+
+func compact(rw http.ResponseWriter, req *http.Request) {
+	stats, err := drain.Compact()
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	body, err := json.Marshal(stats)
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.WriteHeader(200)
+	rw.Write(append(body, byte('\n')))
+}
+
+// backup streams a tar of consistent snapshots of the archive, drain config,
+// and authenticator dbs, which logvac can restore at startup (restore-backup)
+func backup(rw http.ResponseWriter, req *http.Request) {
+	if _, ok := drain.Archiver.(*drain.BoltArchive); !ok {
+		rw.WriteHeader(500)
+		rw.Write([]byte("Archive doesn't support backups"))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/x-tar")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "logvac-"+time.Now().UTC().Format("20060102T150405Z")+".tar"))
+	rw.WriteHeader(200)
+
+	archive := tar.NewWriter(rw)
+	snapshot := func(name string, tx *bolt.Tx) error {
+		err := archive.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    tx.Size(),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tx.WriteTo(archive)
+		return err
+	}
+
+	err := drain.Snapshot(snapshot)
+	if err == nil {
+		err = authenticator.Snapshot(func(tx *bolt.Tx) error {
+			return snapshot("auth.bolt", tx)
+		})
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		// too late to change the status, the client sees a short response
+		config.Log.Error("Failed to back up - %s", err)
+	}
+}
+
+// purgeLogs deletes the logs matching the filters fetching logs takes (see
+// parseFilters), between start and end, or only counts them for a dry run
+// (dryrun=true). Either a filter or a time range is required, so every log of a
+// type isn't purged by mistake.
+func purgeLogs(rw http.ResponseWriter, req *http.Request) {
+	// /logs?type=app&start=0&end=0&id=&tag=&level=&maxlevel=&q=&re=&icase=false&filter=&dryrun=false
+	query := req.URL.Query()
+
+	slice, err := parseFilters(query)
+	if err != nil {
+		badFilters(rw, err)
+		return
+	}
+
+	if start := query.Get("start"); start != "" {
+		if slice.Start, err = drain.ParseTime(start); err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte("bad start offset"))
+			return
+		}
+	}
+	if end := query.Get("end"); end != "" {
+		if slice.End, err = drain.ParseTime(end); err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte("bad end value"))
+			return
+		}
+	}
+
+	bounded := false
+	for _, name := range []string{"start", "end", "id", "tag", "level", "maxlevel", "q", "re", "filter"} {
+		bounded = bounded || query.Get(name) != ""
+	}
+	if !bounded {
+		rw.WriteHeader(400)
+		rw.Write([]byte("refusing to purge every log - give a filter or time range"))
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(query.Get("dryrun"))
+	record, err := drain.Purge(slice, drain.PurgeRecord{
+		By:      req.RemoteAddr,
+		Request: purgeRequest(query),
+		DryRun:  dryRun,
+	})
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	body, err := json.Marshal(record)
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.WriteHeader(200)
+	rw.Write(append(body, byte('\n')))
+}
+
+// purgeRequest describes a purge's filters for its record. Content matches are
+// redacted, they're likely what was leaked.
+func purgeRequest(query url.Values) string {
+	described := url.Values{}
+	for name, values := range query {
+		switch name {
+		case "q", "re", "filter":
+			described.Set(name, "REDACTED")
+		case "X-USER-TOKEN", "x-user-token", "dryrun":
+		default:
+			described[name] = values
+		}
+	}
+	return described.Encode()
+}
+
+func purges(rw http.ResponseWriter, req *http.Request) {
+	records, err := drain.Purges()
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	body, err := json.Marshal(records)
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.WriteHeader(200)
+	rw.Write(append(body, byte('\n')))
+}
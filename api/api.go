@@ -2,17 +2,30 @@
 //
 // ADMIN ROUTES (requires X-AUTH-TOKEN)
 //
-// | Action | Route         | Description          | Payload                          | Output          |
-// |--------|---------------|----------------------|----------------------------------|-----------------|
-// | GET    | /add-token    | Adds a user token    | 'X-USER-TOKEN' Header with token | Success message |
-// | GET    | /remove-token | Removes a user token | 'X-USER-TOKEN' Header with token | Success message |
+// | Action | Route             | Description            | Payload                          | Output          |
+// |--------|-------------------|------------------------|----------------------------------|-----------------|
+// | GET    | /add-token        | Adds a user token      | 'X-USER-TOKEN' Header with token | Success message |
+// | GET    | /remove-token     | Removes a user token   | 'X-USER-TOKEN' Header with token | Success message |
+// | GET    | /stats/redact     | Redactions per rule    | 'X-AUTH-TOKEN' Header with token | json object     |
+// | GET    | /stats/size       | Oversized messages     | 'X-AUTH-TOKEN' Header with token | json object     |
+// | GET    | /stats/archive    | Archive inventory      | 'X-AUTH-TOKEN' Header with token | json object     |
+// | POST   | /admin/compact    | Reclaims archive space | 'X-AUTH-TOKEN' Header with token | json object     |
+// | GET    | /admin/backup     | Snapshots the dbs      | 'X-AUTH-TOKEN' Header with token | tar             |
+// | DELETE | /logs             | Purges matching logs   | 'X-AUTH-TOKEN' Header with token | json object     |
+// | GET    | /admin/purges     | Lists past purges      | 'X-AUTH-TOKEN' Header with token | json array      |
+// | POST   | /admin/holds      | Places a legal hold    | json Hold object                 | json object     |
+// | GET    | /admin/holds      | Lists legal holds      | 'X-AUTH-TOKEN' Header with token | json array      |
+// | DELETE | /admin/holds/{id} | Releases a hold        | 'X-AUTH-TOKEN' Header with token | Success message |
 //
 // USER ROUTES (requires X-USER-TOKEN)
 //
-// | Action | Route | Description       | Payload                          | Output          |
-// |--------|-------|-------------------|----------------------------------|-----------------|
-// | POST   | /logs | Publish a log     | 'X-USER-TOKEN' Header with token | Success message |
-// | GET    | /logs | Fetch stored logs | 'X-USER-TOKEN' Header with token | Success message |
+// | Action | Route                      | Description             | Payload                          | Output           |
+// |--------|----------------------------|-------------------------|----------------------------------|------------------|
+// | POST   | /logs                      | Publish a log           | 'X-USER-TOKEN' Header with token | Success message  |
+// | GET    | /logs                      | Fetch stored logs       | 'X-USER-TOKEN' Header with token | Success message  |
+// | GET    | /logs/stream               | Tail new logs           | 'X-USER-TOKEN' Header with token | SSE or websocket |
+// | GET    | /logs/{type}/{key}/context | Fetch logs around a log | 'X-USER-TOKEN' Header with token | json array       |
+// | GET    | /logs/histogram            | Count logs over time    | 'X-USER-TOKEN' Header with token | json array       |
 //
 package api
 
@@ -20,12 +33,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/pat"
-	"github.com/jcelliott/lumber"
 	"github.com/nanobox-io/golang-nanoauth"
 
 	"github.com/nanopack/logvac/authenticator"
@@ -46,9 +62,23 @@ func Start(collector http.HandlerFunc) error {
 
 	router.Get("/add-token", handleRequest(addKey))
 	router.Get("/remove-token", handleRequest(removeKey))
+	router.Get("/stats/redact", handleRequest(redactStats))
+	router.Get("/stats/size", handleRequest(sizeStats))
+	router.Get("/stats/archive", handleRequest(archiveStats))
+	router.Post("/admin/compact", handleRequest(compact))
+	router.Get("/admin/backup", handleRequest(backup))
+	router.Get("/admin/purges", handleRequest(purges))
+	router.Delete("/admin/holds/{id}", handleRequest(releaseHold))
+	router.Get("/admin/holds", handleRequest(listHolds))
+	router.Post("/admin/holds", handleRequest(placeHold))
+	// users are let through to "/logs" (see authorize), so the admin token is checked here
+	router.Delete("/logs", admin(handleRequest(purgeLogs)))
 	router.Add("OPTIONS", "/", handleRequest(cors))
 
 	router.Post("/logs", verify(handleRequest(collector)))
+	router.Get("/logs/histogram", verify(handleRequest(histogram)))
+	router.Get("/logs/{type}/{key}/context", verify(handleRequest(logContext)))
+	router.Get("/logs/stream", verify(handleRequest(tail)))
 	router.Get("/logs", verify(handleRequest(retriever)))
 
 	cert, _ := nanoauth.Generate("nanobox.io")
@@ -57,14 +87,40 @@ func Start(collector http.HandlerFunc) error {
 		Certificate: cert,
 	}
 
+	// nanoauth only lets exact paths through, so the admin token is checked here
+	handler := authorize(config.Token, router)
+
 	// blocking...
 	if config.Insecure {
 		config.Log.Info("Api Listening on http://%s...", config.ListenHttp)
-		return auth.ListenAndServe(config.ListenHttp, config.Token, router, "/logs")
+		return auth.ListenAndServe(config.ListenHttp, "", handler)
 	}
 
 	config.Log.Info("Api Listening on https://%s...", config.ListenHttp)
-	return auth.ListenAndServeTLS(config.ListenHttp, config.Token, router, "/logs")
+	return auth.ListenAndServeTLS(config.ListenHttp, "", handler)
+}
+
+// authorize requires the admin token (X-AUTH-TOKEN), if set, except on the
+// routes users reach with their own token (see verify)
+func authorize(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if token != "" && !userPath(req.URL.Path) && req.Header.Get("X-AUTH-TOKEN") != token {
+			rw.WriteHeader(401)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// userPath returns true for the paths users reach: /logs, /logs/stream,
+// /logs/histogram, and /logs/{type}/{key}/context
+func userPath(path string) bool {
+	switch path {
+	case "/logs", "/logs/stream", "/logs/histogram":
+		return true
+	}
+	parts := strings.Split(path, "/")
+	return len(parts) == 5 && parts[1] == "logs" && parts[2] != "" && parts[3] != "" && parts[4] == "context"
 }
 
 func cors(rw http.ResponseWriter, req *http.Request) {
@@ -102,6 +158,17 @@ func handleRequest(fn http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// admin requires the admin token (X-AUTH-TOKEN) on user paths (see authorize)
+func admin(fn http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if config.Token != "" && req.Header.Get("X-AUTH-TOKEN") != config.Token {
+			rw.WriteHeader(401)
+			return
+		}
+		fn(rw, req)
+	}
+}
+
 // verify that the token is allowed throught the authenticator
 func verify(fn http.HandlerFunc) http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
@@ -124,18 +191,18 @@ func verify(fn http.HandlerFunc) http.HandlerFunc {
 
 // GenerateArchiveEndpoint generates the endpoint for fetching filtered logs
 // note: javascript number precision may cause unexpected results (missing logs within 100 nanosecond window)
+// when using epoch start/end values, RFC3339 times or cursors avoid this
 func GenerateArchiveEndpoint(archive drain.ArchiverDrain) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
-		// /logs?id=&type=app&start=0&end=0&limit=50
+		// /logs?id=&type=app&start=0&end=0&limit=50&level=&maxlevel=&q=&re=&icase=false&filter=&dir=backward&cursor=&envelope=false&download=false&follow=false&after=&timeout=30&source=hot
 		query := req.URL.Query()
 
-		host := query.Get("id")
-		tag := query["tag"]
-
-		kind := query.Get("type")
-		if kind == "" {
-			kind = config.LogType // "app"
+		slice, err := parseFilters(query)
+		if err != nil {
+			badFilters(res, err)
+			return
 		}
+
 		start := query.Get("start")
 		if start == "" {
 			start = "0"
@@ -144,41 +211,154 @@ func GenerateArchiveEndpoint(archive drain.ArchiverDrain) http.HandlerFunc {
 		if end == "" {
 			end = "0"
 		}
+		// downloads export every matching log unless limited
+		download, _ := strconv.ParseBool(query.Get("download"))
 		limit := query.Get("limit")
 		if limit == "" {
 			limit = "100"
+			if download {
+				limit = "0"
+			}
 		}
-		level := query.Get("level")
-		if level == "" {
-			level = "TRACE"
-		}
-		config.Log.Trace("type: %s, start: %s, end: %s, limit: %s, level: %s, id: %s, tag: %s", kind, start, end, limit, level, host, tag)
-		logLevel := lumber.LvlInt(level)
-		realOffset, err := strconv.ParseInt(start, 0, 64)
+		config.Log.Trace("type: %s, start: %s, end: %s, limit: %s, level: %s, id: %s, tag: %s", slice.Type, start, end, limit, query.Get("level"), slice.Id, slice.Tag)
+		realOffset, err := drain.ParseTime(start)
 		if err != nil {
 			res.WriteHeader(500)
 			res.Write([]byte("bad start offset"))
 			return
 		}
-		realEnd, err := strconv.ParseInt(end, 0, 64)
+		realEnd, err := drain.ParseTime(end)
 		if err != nil {
 			res.WriteHeader(500)
 			res.Write([]byte("bad end value"))
 			return
 		}
-		realLimit, err := strconv.Atoi(limit)
+		realLimit, err := strconv.ParseInt(limit, 10, 64)
 		if err != nil {
 			res.WriteHeader(500)
 			res.Write([]byte("bad limit"))
 			return
 		}
-		slices, err := archive.Slice(kind, host, tag, realOffset, realEnd, int64(realLimit), logLevel)
+		if realLimit == 0 && download {
+			realLimit = math.MaxInt64
+		}
+
+		// pagination
+		var forward bool
+		switch query.Get("dir") {
+		case "", "backward":
+		case "forward":
+			forward = true
+		default:
+			res.WriteHeader(400)
+			res.Write([]byte("bad direction (forward|backward)"))
+			return
+		}
+		var cold bool
+		switch query.Get("source") {
+		case "", "hot":
+		case "cold":
+			cold = true
+		default:
+			res.WriteHeader(400)
+			res.Write([]byte("bad source (hot|cold)"))
+			return
+		}
+		envelope, _ := strconv.ParseBool(query.Get("envelope"))
+		follow, _ := strconv.ParseBool(query.Get("follow"))
+		cursor := query.Get("cursor")
+		if cursor == "" {
+			cursor = query.Get("after")
+		}
+		if cursor != "" {
+			pos, err := decodeCursor(cursor)
+			if err != nil {
+				res.WriteHeader(400)
+				res.Write([]byte("bad cursor"))
+				return
+			}
+			// cursors continue from where the previous page left off
+			forward = pos.Forward
+			if forward {
+				realEnd = pos.UTime
+			} else {
+				realOffset = pos.UTime
+			}
+			envelope = true
+		}
+
+		// follow new logs, starting now unless continuing from a cursor
+		timeout := followTimeout
+		if follow {
+			if cursor == "" {
+				forward = true
+				realEnd = time.Now().UnixNano()
+			}
+			if !forward {
+				res.WriteHeader(400)
+				res.Write([]byte("can't follow backwards"))
+				return
+			}
+			if t := query.Get("timeout"); t != "" {
+				timeout, err = strconv.Atoi(t)
+				if err != nil || timeout < 0 || timeout > followTimeoutMax {
+					res.WriteHeader(400)
+					res.Write([]byte(fmt.Sprintf("bad timeout (0-%d seconds)", followTimeoutMax)))
+					return
+				}
+			}
+		}
+
+		slice.Start = realOffset
+		slice.End = realEnd
+		slice.Limit = realLimit
+		slice.ScanLimit = int64(config.ScanLimit)
+		slice.Forward = forward
+
+		// logs offloaded to cold storage (see cold-address) are only fetched
+		stream := download || strings.Contains(req.Header.Get("Accept"), "application/x-ndjson")
+		read := archive.Slice
+		if cold {
+			bolt, ok := archive.(*drain.BoltArchive)
+			if !ok {
+				res.WriteHeader(500)
+				res.Write([]byte("Archive doesn't support cold storage"))
+				return
+			}
+			if follow || stream {
+				res.WriteHeader(400)
+				res.Write([]byte("can't follow or stream cold logs"))
+				return
+			}
+			read = bolt.SliceCold
+		}
+
+		// long poll for new logs
+		if follow {
+			followLogs(res, req, archive, slice, time.Duration(timeout)*time.Second)
+			return
+		}
+
+		// stream large reads rather than holding them in memory
+		if stream {
+			streamLogs(res, archive, slice, download)
+			return
+		}
+
+		slices, err := read(slice)
 		if err != nil {
 			res.WriteHeader(500)
 			res.Write([]byte(err.Error()))
 			return
 		}
-		body, err := json.Marshal(slices)
+
+		// old clients expect a bare array
+		var body []byte
+		if envelope {
+			body, err = json.Marshal(newPage(slices, slice))
+		} else {
+			body, err = json.Marshal(slices)
+		}
 		if err != nil {
 			res.WriteHeader(500)
 			res.Write([]byte(err.Error()))
@@ -190,6 +370,67 @@ func GenerateArchiveEndpoint(archive drain.ArchiverDrain) http.HandlerFunc {
 	}
 }
 
+// parseFilters reads the filters shared by fetching and purging logs (type, id,
+// tag, level, maxlevel, q, re, icase, filter) into a query
+func parseFilters(query url.Values) (drain.Query, error) {
+	slice := drain.Query{
+		Type:    query.Get("type"),
+		Id:      query["id"],
+		Tag:     query["tag"],
+		Content: query.Get("q"),
+	}
+
+	// query language filter (see filter.go)
+	if f := query.Get("filter"); f != "" {
+		filter, err := parseFilter(f)
+		if err != nil {
+			return slice, err
+		}
+		slice.Predicate = filter.match
+		if slice.Type == "" {
+			kinds, loose := filterTypes(filter)
+			if loose != nil {
+				return slice, &filterError{"can't tell which types to read (give 'type', or AND 'type:' terms, or OR them with each other)", loose.pos}
+			}
+			slice.Type = strings.Join(kinds, ",")
+		}
+	}
+	if slice.Type == "" {
+		slice.Type = config.LogType // "app"
+	}
+
+	var err error
+	slice.Level, slice.Levels, err = parseLevels(query.Get("level"), query.Get("maxlevel"))
+	if err != nil {
+		return slice, err
+	}
+
+	// content filters
+	slice.IgnoreCase, _ = strconv.ParseBool(query.Get("icase"))
+	if expr := query.Get("re"); expr != "" {
+		if slice.IgnoreCase {
+			expr = "(?i)" + expr
+		}
+		slice.Regexp, err = regexp.Compile(expr)
+		if err != nil {
+			return slice, fmt.Errorf("bad regular expression - %s", err)
+		}
+	}
+
+	return slice, nil
+}
+
+// badFilters responds with why the filters were rejected
+func badFilters(rw http.ResponseWriter, err error) {
+	rw.WriteHeader(400)
+	if _, ok := err.(*filterError); ok {
+		body, _ := json.Marshal(err)
+		rw.Write(append(body, byte('\n')))
+		return
+	}
+	rw.Write([]byte(err.Error()))
+}
+
 // parseBody parses the request into v
 func parseBody(req *http.Request, v interface{}) error {
 
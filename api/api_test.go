@@ -2,17 +2,23 @@
 package api_test
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/websocket"
 	"github.com/jcelliott/lumber"
 
 	"github.com/nanopack/logvac/api"
@@ -131,19 +137,804 @@ func TestGetLogs(t *testing.T) {
 		t.Error("bad start is too forgiving")
 		t.FailNow()
 	}
+	// utimes are decimal (not hex)
+	_, err = irest("GET", "/logs?start=0x10", "")
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Error("hex start is too forgiving")
+		t.FailNow()
+	}
 	_, err = irest("GET", "/logs?limit=word", "")
 	if err == nil || strings.Contains(err.Error(), "bad limit") {
 		t.Error("bad limit is too forgiving")
 		t.FailNow()
 	}
 	_, err = irest("GET", "/logs?level=word", "")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Error("bad level is too forgiving")
+		t.FailNow()
+	}
+}
+
+// test searching log content
+func TestSearchLogs(t *testing.T) {
+	body, err := irest("GET", "/logs?type=app&q=TEST&icase=true", "")
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
 	}
+	msg := []logvac.Message{}
+	err = json.Unmarshal(body, &msg)
+	if err != nil {
+		t.Error(fmt.Errorf("Failed to unmarshal - %s", err))
+		t.FailNow()
+	}
+	if len(msg) != 2 || msg[0].Content != "test log" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	body, err = irest("GET", "/logs?type=app&re=%5Elog", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if string(body) != "[]\n" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	_, err = irest("GET", "/logs?re=(", "")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Error("bad regular expression is too forgiving")
+	}
+}
+
+// test filtering logs with the query language
+func TestFilterLogs(t *testing.T) {
+	logs := []string{
+		`{"id":"web1","type":"filtered","tag":["nginx"],"priority":4,"message":"{\"status\":503}"}`,
+		`{"id":"web1","type":"filtered","tag":["web"],"priority":3,"message":"healthcheck status=500"}`,
+		`{"id":"web1","type":"filtered","tag":["web"],"priority":2,"message":"status=500"}`,
+		`{"id":"db1","type":"filtered","tag":["db"],"priority":5,"message":"{\"status\":500}"}`,
+		`{"id":"web2","type":"refiltered","tag":["web"],"priority":2,"message":"status=500"}`,
+	}
+	for i := range logs {
+		if _, err := irest("POST", "/logs", logs[i]); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	filter := `type:filtered AND level>=warn AND (tag:nginx OR tag:web) AND NOT "healthcheck" AND field.status>=500`
+	body, err := irest("GET", "/logs?filter="+url.QueryEscape(filter), "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	msg := []logvac.Message{}
+	err = json.Unmarshal(body, &msg)
+	if err != nil {
+		t.Error(fmt.Errorf("Failed to unmarshal - %s", err))
+		t.FailNow()
+	}
+	if len(msg) != 1 || msg[0].Content != `{"status":503}` {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	// implied AND, or and not
+	body, err = irest("GET", "/logs?type=filtered&filter="+url.QueryEscape(`id:web1 field.status=500 OR NOT tag:web`), "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if err = json.Unmarshal(body, &msg); err != nil {
+		t.Error(fmt.Errorf("Failed to unmarshal - %s", err))
+		t.FailNow()
+	}
+	if len(msg) != 4 {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	// ored types are all read
+	body, err = irest("GET", "/logs?filter="+url.QueryEscape(`(type:filtered OR type:refiltered) AND field.status=500`), "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if err = json.Unmarshal(body, &msg); err != nil {
+		t.Error(fmt.Errorf("Failed to unmarshal - %s", err))
+		t.FailNow()
+	}
+	if len(msg) != 4 || msg[3].Id != "web2" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+	// but types that can't be told aren't guessed
+	for _, filter := range []string{`type:filtered OR level>=error`, `NOT type:filtered`, `type!=filtered`} {
+		_, err = irest("GET", "/logs?filter="+url.QueryEscape(filter), "")
+		if err == nil || !strings.Contains(err.Error(), "400") {
+			t.Errorf("%s is too forgiving", filter)
+		}
+	}
+
+	// parse errors are described
+	res, err := http.Get(fmt.Sprintf("http://%s/logs?filter=%s", insecureHttp, url.QueryEscape(`level>=loud`)))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	var parseErr struct {
+		Error    string `json:"error"`
+		Position int    `json:"position"`
+	}
+	if err = json.Unmarshal(body, &parseErr); err != nil {
+		t.Error(fmt.Errorf("Failed to unmarshal - %s", err))
+	}
+	if res.StatusCode != 400 || !strings.Contains(parseErr.Error, "loud") || parseErr.Position != 7 {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	_, err = irest("GET", "/logs?filter="+url.QueryEscape(`(tag:web`), "")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Error("unclosed parenthesis is too forgiving")
+	}
+}
+
+// test filtering logs by level ranges and lists
+func TestLevelLogs(t *testing.T) {
+	// logs posted by TestFilterLogs (priorities 4, 3, 2, 5)
+	tests := map[string]int{
+		"level=warn":             3,
+		"level=warn..error":      2,
+		"level=..info":           1,
+		"level=error,fatal":      2,
+		"level=info,fatal":       2,
+		"level=debug&maxlevel=3": 2,
+		"maxlevel=error":         3,
+	}
+	for params, expected := range tests {
+		body, err := irest("GET", "/logs?type=filtered&"+params, "")
+		if err != nil {
+			t.Errorf("%s: %s", params, err)
+			continue
+		}
+		msg := []logvac.Message{}
+		if err = json.Unmarshal(body, &msg); err != nil {
+			t.Error(fmt.Errorf("Failed to unmarshal - %s", err))
+			continue
+		}
+		if len(msg) != expected {
+			t.Errorf("%s: %q doesn't match expected out", params, body)
+		}
+	}
+
+	for _, params := range []string{"level=loud", "level=warn..loud", "level=error..warn", "maxlevel=7", "level=error,fatal&maxlevel=warn"} {
+		_, err := irest("GET", "/logs?type=filtered&"+params, "")
+		if err == nil || !strings.Contains(err.Error(), "400") {
+			t.Errorf("%s is too forgiving", params)
+		}
+	}
+}
+
+// test fetching the logs around a log
+func TestContextLogs(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		_, err := irest("POST", "/logs", fmt.Sprintf("{\"id\":\"ctx-%d\",\"type\":\"context\",\"message\":\"context log %d\"}", i%2, i))
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	context := func(route string) []logvac.Message {
+		msg := []logvac.Message{}
+		body, err := irest("GET", route, "")
+		if err != nil {
+			t.Error(err)
+			return msg
+		}
+		if err = json.Unmarshal(body, &msg); err != nil {
+			t.Error(fmt.Errorf("Failed to unmarshal - %s", err))
+		}
+		return msg
+	}
+	contents := func(msg []logvac.Message) string {
+		var c []string
+		for i := range msg {
+			c = append(c, msg[i].Content)
+		}
+		return strings.Join(c, ",")
+	}
+
+	found := context("/logs?type=context&id=ctx-0&q=log%202")
+	if len(found) != 1 {
+		t.Errorf("%+v doesn't match expected out", found)
+		t.FailNow()
+	}
+	key := found[0].UTime
+
+	// the same id by default
+	msg := context(fmt.Sprintf("/logs/context/%d/context?before=1&after=5", key))
+	if contents(msg) != "context log 0,context log 2,context log 4" {
+		t.Errorf("%q doesn't match expected out", contents(msg))
+	}
+	msg = context(fmt.Sprintf("/logs/context/%d/context?id=ctx-1", key))
+	if contents(msg) != "context log 1,context log 2,context log 3" {
+		t.Errorf("%q doesn't match expected out", contents(msg))
+	}
+
+	_, err := irest("GET", fmt.Sprintf("/logs/context/%d/context", key+1), "")
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Error("missing log is too forgiving")
+	}
+	_, err = irest("GET", fmt.Sprintf("/logs/context/%d/context?before=word", key), "")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Error("bad before count is too forgiving")
+	}
+
+	// users fetch context without the admin token, as they do logs
+	req, _ := http.NewRequest("GET", fmt.Sprintf("https://%s/logs/context/%d/context", secureHttp, key), nil)
+	req.Header.Add("X-USER-TOKEN", "user")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("Status '200' expected, got '%d'", res.StatusCode)
+	}
+	// but admin routes still need it
+	req, _ = http.NewRequest("GET", fmt.Sprintf("https://%s/drains", secureHttp), nil)
+	req.Header.Add("X-USER-TOKEN", "user")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("Status '401' expected, got '%d'", res.StatusCode)
+	}
+}
+
+// test counting logs over time
+func TestHistogramLogs(t *testing.T) {
+	// logs posted by TestFilterLogs (priorities 4, 3, 2, 5)
+	body, err := irest("GET", "/logs/histogram?type=filtered&interval=1d&group=level&from="+url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339)), "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	buckets := []drain.HistogramBucket{}
+	if err = json.Unmarshal(body, &buckets); err != nil {
+		t.Error(fmt.Errorf("Failed to unmarshal - %s", err))
+		t.FailNow()
+	}
+	var count, warn int64
+	for i := range buckets {
+		count += buckets[i].Count
+		warn += buckets[i].Groups["warn"]
+	}
+	if count != 4 || warn != 1 {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	for _, params := range []string{"group=host", "interval=1q", "interval=1s&from=1&to=1000000000000000000"} {
+		_, err := irest("GET", "/logs/histogram?"+params, "")
+		if err == nil || !strings.Contains(err.Error(), "400") {
+			t.Errorf("%s is too forgiving", params)
+		}
+	}
+
+	// by default the histogram starts at the oldest log, over 10000 minutes ago
+	drain.Archiver.Write(logvac.Message{
+		Time:     time.Now().Add(-8 * 24 * time.Hour),
+		UTime:    time.Now().Add(-8 * 24 * time.Hour).UnixNano(),
+		Id:       "web1",
+		Type:     "histold",
+		Priority: 2,
+		Content:  "old news",
+	})
+	_, err = irest("GET", "/logs/histogram?type=histold", "")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("Expected too many default intervals to be rejected, got %v", err)
+	}
+	body, err = irest("GET", "/logs/histogram?type=histold&interval=1h", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	buckets = []drain.HistogramBucket{}
+	if err = json.Unmarshal(body, &buckets); err != nil {
+		t.Error(fmt.Errorf("Failed to unmarshal - %s", err))
+		t.FailNow()
+	}
+	if len(buckets) < 8*24 || buckets[0].Count != 1 {
+		t.Errorf("Expected hourly intervals from the oldest log, got %d intervals", len(buckets))
+	}
+
+	// nothing to count
+	body, err = irest("GET", "/logs/histogram?type=histnone", "")
+	if err != nil || string(body) != "[]\n" {
+		t.Errorf("%q doesn't match expected out - %v", body, err)
+	}
+}
+
+// test describing the archive
+func TestArchiveStats(t *testing.T) {
+	body, err := rest("GET", "/stats/archive?top=1", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	stats := drain.ArchiveStats{}
+	if err = json.Unmarshal(body, &stats); err != nil {
+		t.Error(fmt.Errorf("Failed to unmarshal - %s", err))
+		t.FailNow()
+	}
+	// logs posted by TestFilterLogs
+	filtered, ok := stats.Types["filtered"]
+	if !ok || filtered.Count != 4 || len(filtered.TopIds) != 1 || filtered.TopIds[0].Id != "web1" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	_, err = irest("GET", "/stats/archive?top=word", "")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Error("bad top count is too forgiving")
+	}
+}
+
+// test fetching logs from cold storage
+func TestColdLogs(t *testing.T) {
+	for _, params := range []string{"source=lukewarm", "source=cold&follow=true", "source=cold&download=true"} {
+		_, err := irest("GET", "/logs?type=app&"+params, "")
+		if err == nil || !strings.Contains(err.Error(), "400") {
+			t.Errorf("%s is too forgiving", params)
+		}
+	}
+
+	// not configured
+	_, err := irest("GET", "/logs?type=app&source=cold", "")
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("Expected cold logs to fail without cold storage, got %v", err)
+	}
+}
+
+// test backing up the dbs
+func TestBackup(t *testing.T) {
+	body, err := rest("GET", "/admin/backup", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	backup := tar.NewReader(bytes.NewReader(body))
+	header, err := backup.Next()
+	if err != nil || header.Name != "archive.bolt" {
+		t.Errorf("Expected the archive first, got %+v - %v", header, err)
+		t.FailNow()
+	}
+
+	// partitions follow, as usable dbs
+	os.MkdirAll("/tmp/apiTest/backup", 0755)
+	filtered := 0
+	for {
+		header, err = backup.Next()
+		if err != nil {
+			break
+		}
+		if !strings.HasPrefix(header.Name, "archive.partitions/filtered/") {
+			continue
+		}
+		file, _ := os.Create("/tmp/apiTest/backup/filtered.bolt")
+		io.Copy(file, backup)
+		file.Close()
+
+		db, err := bolt.Open("/tmp/apiTest/backup/filtered.bolt", 0644, &bolt.Options{ReadOnly: true})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		db.View(func(tx *bolt.Tx) error {
+			// logs posted by TestFilterLogs
+			if b := tx.Bucket([]byte("filtered")); b != nil {
+				filtered += b.Stats().KeyN
+			}
+			return nil
+		})
+		db.Close()
+	}
+	if err != io.EOF || filtered != 4 {
+		t.Errorf("Expected 4 filtered logs in backup, got %d - %v", filtered, err)
+	}
+
+	_, err = irest("GET", "/admin/backup", "")
+	if err != nil {
+		t.Error(err)
+	}
 }
 
 // test removing an auth token
+// test streaming and downloading logs
+func TestStreamLogs(t *testing.T) {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/logs?type=app&id=log-test", insecureHttp), nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("%q doesn't match expected content type", res.Header.Get("Content-Type"))
+	}
+
+	// streamed newest first, one log per line
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) != 2 {
+		t.Errorf("%q doesn't match expected out", body)
+		t.FailNow()
+	}
+	var newest, oldest logvac.Message
+	if err = json.Unmarshal([]byte(lines[0]), &newest); err != nil {
+		t.Error(fmt.Errorf("Failed to unmarshal - %s", err))
+	}
+	if err = json.Unmarshal([]byte(lines[1]), &oldest); err != nil {
+		t.Error(fmt.Errorf("Failed to unmarshal - %s", err))
+	}
+	if newest.UTime <= oldest.UTime || newest.Content != "test log" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	res, err = http.Get(fmt.Sprintf("http://%s/logs?type=app&id=log-test&download=true", insecureHttp))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.HasPrefix(res.Header.Get("Content-Disposition"), "attachment; filename=\"logvac-app-") {
+		t.Errorf("%q doesn't match expected disposition", res.Header.Get("Content-Disposition"))
+	}
+	if strings.Count(string(body), "\n") != 2 {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+}
+
+// test paginating logs with cursors
+func TestPaginateLogs(t *testing.T) {
+	type page struct {
+		Logs []logvac.Message `json:"logs"`
+		Next string           `json:"next"`
+		Prev string           `json:"prev"`
+	}
+	getPage := func(route string) page {
+		body, err := irest("GET", route, "")
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		p := page{}
+		err = json.Unmarshal(body, &p)
+		if err != nil {
+			t.Error(fmt.Errorf("Failed to unmarshal - %s", err))
+			t.FailNow()
+		}
+		return p
+	}
+
+	// newest first
+	newest := getPage("/logs?type=app&id=log-test&limit=1&envelope=true")
+	if len(newest.Logs) != 1 || newest.Prev == "" || newest.Next == "" {
+		t.Errorf("%+v doesn't match expected out", newest)
+		t.FailNow()
+	}
+	older := getPage("/logs?type=app&id=log-test&limit=1&cursor=" + newest.Prev)
+	if len(older.Logs) != 1 || older.Logs[0].UTime >= newest.Logs[0].UTime {
+		t.Errorf("%+v doesn't match expected out", older)
+	}
+	oldest := getPage("/logs?type=app&id=log-test&limit=1&cursor=" + older.Prev)
+	if len(oldest.Logs) != 0 || oldest.Prev != "" {
+		t.Errorf("%+v doesn't match expected out", oldest)
+	}
+
+	// oldest first
+	first := getPage("/logs?type=app&id=log-test&limit=1&dir=forward&envelope=true")
+	if len(first.Logs) != 1 || first.Logs[0].UTime != older.Logs[0].UTime {
+		t.Errorf("%+v doesn't match expected out", first)
+	}
+	second := getPage("/logs?type=app&id=log-test&limit=1&cursor=" + first.Next)
+	if len(second.Logs) != 1 || second.Logs[0].UTime != newest.Logs[0].UTime {
+		t.Errorf("%+v doesn't match expected out", second)
+	}
+	last := getPage("/logs?type=app&id=log-test&limit=1&cursor=" + second.Next)
+	if len(last.Logs) != 0 || last.Next != second.Next {
+		t.Errorf("%+v doesn't match expected out", last)
+	}
+
+	// rfc3339 bounds
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	bounded := getPage("/logs?type=app&id=log-test&envelope=true&end=" + future)
+	if len(bounded.Logs) != 0 {
+		t.Errorf("%+v doesn't match expected out", bounded)
+	}
+
+	_, err := irest("GET", "/logs?cursor=word", "")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Error("bad cursor is too forgiving")
+	}
+	_, err = irest("GET", "/logs?dir=sideways", "")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Error("bad direction is too forgiving")
+	}
+}
+
+// test tailing logs
+func TestTailLogs(t *testing.T) {
+	// server-sent events, replaying the newest archived log
+	res, err := http.Get(fmt.Sprintf("http://%s/logs/stream?type=app&id=log-test&replay=1", insecureHttp))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("%q doesn't match expected content type", res.Header.Get("Content-Type"))
+	}
+
+	events := make(chan logvac.Message)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if !strings.HasPrefix(scanner.Text(), "data: ") {
+				continue
+			}
+			msg := logvac.Message{}
+			json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data: ")), &msg)
+			events <- msg
+		}
+	}()
+
+	// websocket
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/logs/stream?type=app&id=tail-test", insecureHttp), nil)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer ws.Close()
+
+	next := func() logvac.Message {
+		select {
+		case msg := <-events:
+			return msg
+		case <-time.After(time.Second):
+			t.Error("Timed out waiting for tailed log")
+			return logvac.Message{}
+		}
+	}
+
+	replayed := next()
+	if replayed.Content != "test log" {
+		t.Errorf("%+v doesn't match expected out", replayed)
+	}
+
+	// only matching logs are tailed
+	_, err = irest("POST", "/logs", "{\"id\":\"other\",\"type\":\"app\",\"message\":\"other log\"}")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = irest("POST", "/logs", "{\"id\":\"log-test\",\"type\":\"app\",\"message\":\"tailed log\"}")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = irest("POST", "/logs", "{\"id\":\"tail-test\",\"type\":\"app\",\"message\":\"socket log\"}")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if msg := next(); msg.Content != "tailed log" {
+		t.Errorf("%+v doesn't match expected out", msg)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	msg := logvac.Message{}
+	if err = ws.ReadJSON(&msg); err != nil {
+		t.Error(err)
+	}
+	if msg.Content != "socket log" {
+		t.Errorf("%+v doesn't match expected out", msg)
+	}
+
+	_, err = irest("GET", "/logs/stream?replay=word", "")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Error("bad replay is too forgiving")
+	}
+}
+
+// test following logs with long polling
+func TestFollowLogs(t *testing.T) {
+	type page struct {
+		Logs []logvac.Message `json:"logs"`
+		Next string           `json:"next"`
+	}
+	follow := func(route string) (page, error) {
+		p := page{}
+		body, err := irest("GET", route, "")
+		if err != nil {
+			return p, err
+		}
+		return p, json.Unmarshal(body, &p)
+	}
+
+	// nothing new
+	empty, err := follow("/logs?type=app&id=follow-test&follow=true&timeout=0")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(empty.Logs) != 0 || empty.Next == "" {
+		t.Errorf("%+v doesn't match expected out", empty)
+		t.FailNow()
+	}
+
+	// wait for a new log
+	followed := make(chan page)
+	go func() {
+		p, err := follow("/logs?type=app&id=follow-test&follow=true&timeout=5&after=" + empty.Next)
+		if err != nil {
+			t.Error(err)
+		}
+		followed <- p
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	_, err = irest("POST", "/logs", "{\"id\":\"follow-test\",\"type\":\"app\",\"message\":\"followed log\"}")
+	if err != nil {
+		t.Error(err)
+	}
+	p := <-followed
+	if len(p.Logs) != 1 || p.Logs[0].Content != "followed log" || p.Next == empty.Next {
+		t.Errorf("%+v doesn't match expected out", p)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("Follow waited for the timeout")
+	}
+
+	_, err = irest("GET", "/logs?follow=true&timeout=9000", "")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Error("bad timeout is too forgiving")
+	}
+}
+
+// test purging logs
+func TestPurgeLogs(t *testing.T) {
+	for i := 0; i < 4; i++ {
+		_, err := irest("POST", "/logs", fmt.Sprintf("{\"id\":\"leaky\",\"type\":\"leaked\",\"message\":\"token=%d\"}", i%2))
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// the admin token is required, even though users may fetch logs
+	_, err := irest("DELETE", "/logs?type=leaked&q=token%3D1", "")
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Error("purged logs without the admin token")
+	}
+
+	purge := func(route string) drain.PurgeRecord {
+		record := drain.PurgeRecord{}
+		body, err := rest("DELETE", route, "")
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if err = json.Unmarshal(body, &record); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		return record
+	}
+
+	if record := purge("/logs?type=leaked&q=token%3D1&dryrun=true"); !record.DryRun || record.Deleted != 2 {
+		t.Errorf("%+v doesn't match expected out", record)
+	}
+	if record := purge("/logs?type=leaked&q=token%3D1"); record.DryRun || record.Deleted != 2 {
+		t.Errorf("%+v doesn't match expected out", record)
+	}
+
+	body, err := rest("GET", "/logs?type=leaked", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	msgs := []logvac.Message{}
+	json.Unmarshal(body, &msgs)
+	if len(msgs) != 2 || msgs[0].Content != "token=0" || msgs[1].Content != "token=0" {
+		t.Errorf("%+v doesn't match expected out", msgs)
+	}
+
+	// the audit record doesn't repeat what was leaked
+	body, err = rest("GET", "/admin/purges", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	records := []drain.PurgeRecord{}
+	json.Unmarshal(body, &records)
+	if len(records) != 1 || records[0].Deleted != 2 || strings.Contains(records[0].Request, "token") {
+		t.Errorf("%+v doesn't match expected out", records)
+	}
+
+	// every log of a type isn't purged by mistake
+	_, err = rest("DELETE", "/logs?type=leaked", "")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Error("purged without a filter")
+	}
+}
+
+// test placing and releasing legal holds
+func TestHolds(t *testing.T) {
+	_, err := irest("POST", "/logs", "{\"id\":\"suspect\",\"type\":\"incident\",\"message\":\"evidence\"}")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	body, err := rest("POST", "/admin/holds", "{\"type\":\"incident\",\"ids\":[\"suspect\"],\"reason\":\"case 42\"}")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	hold := drain.Hold{}
+	if err = json.Unmarshal(body, &hold); err != nil || hold.Id == "" || hold.Placed.IsZero() {
+		t.Errorf("%+v doesn't match expected out - %v", hold, err)
+		t.FailNow()
+	}
+
+	_, err = rest("POST", "/admin/holds", "{\"type\":\"incident\"}")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Error("placed a hold without a reason")
+	}
+
+	body, err = rest("GET", "/admin/holds", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	holds := []drain.Hold{}
+	json.Unmarshal(body, &holds)
+	if len(holds) != 1 || holds[0].Reason != "case 42" {
+		t.Errorf("%+v doesn't match expected out", holds)
+	}
+
+	// held logs aren't purged
+	record := drain.PurgeRecord{}
+	body, err = rest("DELETE", "/logs?type=incident&id=suspect", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	json.Unmarshal(body, &record)
+	if record.Deleted != 0 || record.Held != 1 {
+		t.Errorf("%+v doesn't match expected out", record)
+	}
+
+	if _, err = rest("DELETE", "/admin/holds/"+hold.Id, ""); err != nil {
+		t.Error(err)
+	}
+	_, err = rest("DELETE", "/admin/holds/"+hold.Id, "")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Error("released a hold twice")
+	}
+}
+
 func TestRemoveToken(t *testing.T) {
 	body, err := rest("GET", "/remove-token", "")
 	if err != nil {
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/nanopack/logvac/config"
+	"github.com/nanopack/logvac/core"
+	"github.com/nanopack/logvac/drain"
+)
+
+const (
+	contextLogs    = 50   // logs before and after a log sent by default
+	contextLogsMax = 1000 // max logs before and after a log a client may ask for
+)
+
+// logContext responds with a log (by type and key, its utime) and the logs
+// before and after it from the same id (or the ids given), oldest first,
+// whether or not they match the filters the log was found with
+func logContext(rw http.ResponseWriter, req *http.Request) {
+	// /logs/{type}/{key}/context?before=50&after=50&id=
+	query := req.URL.Query()
+
+	kind := query.Get(":type")
+	key, err := drain.ParseTime(query.Get(":key"))
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte("bad key"))
+		return
+	}
+
+	count := func(param string) (int64, error) {
+		value := query.Get(param)
+		if value == "" {
+			return contextLogs, nil
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 || n > contextLogsMax {
+			return 0, fmt.Errorf("bad %s count (0-%d)", param, contextLogsMax)
+		}
+		return n, nil
+	}
+	before, err := count("before")
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	after, err := count("after")
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	if drain.Archiver == nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte("no archive configured"))
+		return
+	}
+
+	// the log itself (logs are keyed by utime)
+	found, err := drain.Archiver.Slice(drain.Query{Type: kind, Start: key, End: key, Limit: 1})
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if len(found) == 0 {
+		rw.WriteHeader(404)
+		rw.Write([]byte("log not found"))
+		return
+	}
+
+	ids := query["id"]
+	if len(ids) == 0 {
+		ids = []string{found[0].Id}
+	}
+
+	// slices are returned oldest first either way
+	older, err := drain.Archiver.Slice(drain.Query{
+		Type:      kind,
+		Id:        ids,
+		Start:     key - 1,
+		Limit:     before,
+		ScanLimit: int64(config.ScanLimit),
+	})
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	newer, err := drain.Archiver.Slice(drain.Query{
+		Type:      kind,
+		Id:        ids,
+		End:       key + 1,
+		Limit:     after,
+		ScanLimit: int64(config.ScanLimit),
+		Forward:   true,
+	})
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	logs := make([]logvac.Message, 0, len(older)+1+len(newer))
+	logs = append(append(append(logs, older...), found[0]), newer...)
+
+	body, err := json.Marshal(logs)
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.WriteHeader(200)
+	rw.Write(append(body, byte('\n')))
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nanopack/logvac/config"
+	"github.com/nanopack/logvac/core"
+	"github.com/nanopack/logvac/drain"
+)
+
+// logs are flushed to the client every flushEvery logs while streaming
+const flushEvery = 100
+
+// streamLogs writes the logs matching the query as newline delimited json as
+// they're read, rather than holding them all in memory. Downloads are sent as
+// an attachment.
+func streamLogs(res http.ResponseWriter, archive drain.ArchiverDrain, query drain.Query, download bool) {
+	res.Header().Set("Content-Type", "application/x-ndjson")
+	if download {
+		name := fmt.Sprintf("logvac-%s-%s.ndjson", url.PathEscape(strings.NewReplacer("*", "all", ",", "+").Replace(query.Type)), time.Now().UTC().Format("20060102T150405Z"))
+		res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	}
+	res.WriteHeader(200)
+
+	flusher, _ := res.(http.Flusher)
+	encoder := json.NewEncoder(res)
+	written := 0
+
+	err := archive.Walk(query, func(msg logvac.Message) error {
+		if err := encoder.Encode(msg); err != nil {
+			return err
+		}
+		written++
+		if flusher != nil && written%flushEvery == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// too late to change the status, the client sees a short response
+		config.Log.Error("Failed to stream logs - %s", err)
+	}
+
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
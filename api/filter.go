@@ -0,0 +1,457 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nanopack/logvac/core"
+)
+
+// filters are a small query language for searching logs, eg:
+//
+//   type:app AND level>=warn AND (tag:nginx OR tag:web) AND NOT "healthcheck" AND field.status>=500
+//
+// Terms are `field op value` (fields: type, id, tag, level, message, field.<name>;
+// ops: `:`, `=`, `!=`, and `>`, `>=`, `<`, `<=` for level and field.<name>) or
+// text (quoted or not) that the message must contain. Terms are combined with
+// AND (or just a space), OR, NOT, and parentheses. field.<name> reads a value
+// from json messages (field.a.b for nested values) or `name=value` pairs.
+
+type (
+	// filterNode is a parsed filter
+	filterNode interface {
+		match(msg logvac.Message) bool
+	}
+
+	andNode  struct{ left, right filterNode }
+	orNode   struct{ left, right filterNode }
+	notNode  struct{ node filterNode }
+	textNode struct{ text string }
+
+	// termNode compares a field of the message to a value
+	termNode struct {
+		field string
+		op    string
+		value string
+		level int // value as a level (level only)
+		pos   int // offset (bytes) into the filter
+	}
+
+	// filterError describes why and where a filter failed to parse
+	filterError struct {
+		Message  string `json:"error"`
+		Position int    `json:"position"` // offset (bytes) into the filter
+	}
+
+	filterToken struct {
+		kind int
+		text string
+		pos  int
+	}
+
+	filterParser struct {
+		tokens []filterToken
+		next   int
+	}
+)
+
+const (
+	tokWord = iota
+	tokString
+	tokOp
+	tokOpen
+	tokClose
+	tokEnd
+)
+
+func (e *filterError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Message, e.Position)
+}
+
+// parseFilter parses a filter, returning a *filterError if it is malformed
+func parseFilter(filter string) (filterNode, error) {
+	tokens, err := lexFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEnd {
+		return nil, &filterError{fmt.Sprintf("unexpected '%s'", t.text), t.pos}
+	}
+	return node, nil
+}
+
+// lexFilter splits a filter into tokens
+func lexFilter(filter string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(filter); {
+		c := filter[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(':
+			tokens = append(tokens, filterToken{tokOpen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, filterToken{tokClose, ")", i})
+			i++
+		case c == '"':
+			// quoted text, with \" and \\ escapes
+			text := []byte{}
+			j := i + 1
+			for ; j < len(filter) && filter[j] != '"'; j++ {
+				if filter[j] == '\\' && j+1 < len(filter) {
+					j++
+				}
+				text = append(text, filter[j])
+			}
+			if j == len(filter) {
+				return nil, &filterError{"unterminated quote", i}
+			}
+			tokens = append(tokens, filterToken{tokString, string(text), i})
+			i = j + 1
+		case strings.IndexByte(":=!<>", c) != -1:
+			op := string(c)
+			if i+1 < len(filter) && filter[i+1] == '=' && c != ':' && c != '=' {
+				op += "="
+			}
+			if op == "!" {
+				return nil, &filterError{"expected '!='", i}
+			}
+			tokens = append(tokens, filterToken{tokOp, op, i})
+			i += len(op)
+		default:
+			j := i
+			for ; j < len(filter) && strings.IndexByte(" \t\n()\":=!<>", filter[j]) == -1; j++ {
+			}
+			tokens = append(tokens, filterToken{tokWord, filter[i:j], i})
+			i = j
+		}
+	}
+
+	return append(tokens, filterToken{tokEnd, "end of filter", len(filter)}), nil
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) take() filterToken {
+	t := p.tokens[p.next]
+	if t.kind != tokEnd {
+		p.next++
+	}
+	return t
+}
+
+// keyword returns true if the token is the (case-insensitive) keyword
+func keyword(t filterToken, word string) bool {
+	return t.kind == tokWord && strings.EqualFold(t.text, word)
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for keyword(p.peek(), "OR") {
+		p.take()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind == tokEnd || t.kind == tokClose || keyword(t, "OR") {
+			return left, nil
+		}
+		// AND is implied between terms
+		if keyword(t, "AND") {
+			p.take()
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	if keyword(p.peek(), "NOT") {
+		p.take()
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node}, nil
+	}
+	return p.parseTerm()
+}
+
+func (p *filterParser) parseTerm() (filterNode, error) {
+	t := p.take()
+	switch t.kind {
+	case tokOpen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.take(); c.kind != tokClose {
+			return nil, &filterError{fmt.Sprintf("expected ')' but found '%s'", c.text), c.pos}
+		}
+		return node, nil
+	case tokString:
+		return textNode{t.text}, nil
+	case tokWord:
+		if keyword(t, "AND") || keyword(t, "OR") {
+			return nil, &filterError{fmt.Sprintf("expected a term but found '%s'", t.text), t.pos}
+		}
+		if p.peek().kind != tokOp {
+			return textNode{t.text}, nil
+		}
+		return p.parseComparison(t)
+	default:
+		return nil, &filterError{fmt.Sprintf("expected a term but found '%s'", t.text), t.pos}
+	}
+}
+
+// parseComparison parses the rest of a `field op value` term
+func (p *filterParser) parseComparison(field filterToken) (filterNode, error) {
+	op := p.take()
+	value := p.take()
+	if value.kind != tokWord && value.kind != tokString {
+		return nil, &filterError{fmt.Sprintf("expected a value but found '%s'", value.text), value.pos}
+	}
+
+	term := termNode{field: strings.ToLower(field.text), op: op.text, value: value.text, pos: field.pos}
+	ordered := op.text != ":" && op.text != "=" && op.text != "!="
+
+	switch {
+	case term.field == "level":
+		level, err := parseLevel(value.text)
+		if err != nil {
+			return nil, &filterError{err.Error(), value.pos}
+		}
+		term.level = level
+	case strings.HasPrefix(term.field, "field.") && len(term.field) > len("field."):
+		term.field = "field." + field.text[len("field."):] // field names are case sensitive
+	case term.field == "type", term.field == "id", term.field == "tag", term.field == "message":
+		if ordered {
+			return nil, &filterError{fmt.Sprintf("can't compare %s with '%s'", term.field, op.text), op.pos}
+		}
+	default:
+		return nil, &filterError{fmt.Sprintf("unknown field '%s' (type|id|tag|level|message|field.<name>)", field.text), field.pos}
+	}
+
+	return term, nil
+}
+
+func (n andNode) match(msg logvac.Message) bool {
+	return n.left.match(msg) && n.right.match(msg)
+}
+
+func (n orNode) match(msg logvac.Message) bool {
+	return n.left.match(msg) || n.right.match(msg)
+}
+
+func (n notNode) match(msg logvac.Message) bool {
+	return !n.node.match(msg)
+}
+
+func (n textNode) match(msg logvac.Message) bool {
+	return strings.Contains(msg.Content, n.text)
+}
+
+func (n termNode) match(msg logvac.Message) bool {
+	switch n.field {
+	case "type":
+		return equals(n.op, msg.Type == n.value)
+	case "id":
+		return equals(n.op, msg.Id == n.value)
+	case "tag":
+		has := false
+		for i := range msg.Tag {
+			if msg.Tag[i] == n.value {
+				has = true
+				break
+			}
+		}
+		return equals(n.op, has)
+	case "message":
+		if n.op == ":" {
+			return strings.Contains(msg.Content, n.value)
+		}
+		return equals(n.op, msg.Content == n.value)
+	case "level":
+		return compare(n.op, msg.Priority-n.level)
+	}
+
+	value, ok := fieldValue(msg.Content, n.field[len("field."):])
+	if !ok {
+		return false
+	}
+	// compare numerically if both are numbers
+	a, errA := strconv.ParseFloat(value, 64)
+	b, errB := strconv.ParseFloat(n.value, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case a < b:
+			return compare(n.op, -1)
+		case a > b:
+			return compare(n.op, 1)
+		}
+		return compare(n.op, 0)
+	}
+	return compare(n.op, strings.Compare(value, n.value))
+}
+
+// equals applies an equality op to whether the values are equal
+func equals(op string, equal bool) bool {
+	if op == "!=" {
+		return !equal
+	}
+	return equal
+}
+
+// compare applies an op to the result of comparing two values (-1, 0, 1)
+func compare(op string, cmp int) bool {
+	switch op {
+	case ":", "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	default: // "<="
+		return cmp <= 0
+	}
+}
+
+// fieldValue returns the value of a field of a json message (dots separate
+// nested fields) or of a `name=value` pair in the message
+func fieldValue(content, name string) (string, bool) {
+	if strings.HasPrefix(strings.TrimSpace(content), "{") {
+		var value interface{}
+		if json.Unmarshal([]byte(content), &value) == nil {
+			for _, key := range strings.Split(name, ".") {
+				obj, ok := value.(map[string]interface{})
+				if !ok {
+					return "", false
+				}
+				if value, ok = obj[key]; !ok {
+					return "", false
+				}
+			}
+			switch v := value.(type) {
+			case string:
+				return v, true
+			case float64:
+				return strconv.FormatFloat(v, 'f', -1, 64), true
+			case bool, nil:
+				return fmt.Sprint(v), true
+			default:
+				return "", false
+			}
+		}
+	}
+
+	for _, pair := range strings.Fields(content) {
+		if strings.HasPrefix(pair, name+"=") {
+			return strings.Trim(pair[len(name)+1:], `"`), true
+		}
+	}
+	return "", false
+}
+
+// filterTypes returns the types a filter requires (`type:x` anded at the top
+// level, or ored with other `type:` terms), if any. A `type:` term that doesn't
+// narrow the types (negated, or ored with other terms) is returned instead.
+func filterTypes(node filterNode) ([]string, *termNode) {
+	switch n := node.(type) {
+	case termNode:
+		if n.field != "type" {
+			return nil, nil
+		}
+		if n.op == "!=" {
+			return nil, &n
+		}
+		return []string{n.value}, nil
+	case andNode:
+		left, leftLoose := filterTypes(n.left)
+		if left != nil {
+			return left, nil
+		}
+		right, rightLoose := filterTypes(n.right)
+		if right != nil {
+			return right, nil
+		}
+		if leftLoose != nil {
+			return nil, leftLoose
+		}
+		return nil, rightLoose
+	case orNode:
+		left, _ := filterTypes(n.left)
+		right, _ := filterTypes(n.right)
+		if left != nil && right != nil {
+		next:
+			for _, kind := range right {
+				for i := range left {
+					if left[i] == kind {
+						continue next
+					}
+				}
+				left = append(left, kind)
+			}
+			return left, nil
+		}
+		return nil, typeTerm(n)
+	case notNode:
+		return nil, typeTerm(n.node)
+	}
+	return nil, nil
+}
+
+// typeTerm returns the first `type` term of a filter, if any
+func typeTerm(node filterNode) *termNode {
+	switch n := node.(type) {
+	case termNode:
+		if n.field == "type" {
+			return &n
+		}
+	case andNode:
+		if term := typeTerm(n.left); term != nil {
+			return term
+		}
+		return typeTerm(n.right)
+	case orNode:
+		if term := typeTerm(n.left); term != nil {
+			return term
+		}
+		return typeTerm(n.right)
+	case notNode:
+		return typeTerm(n.node)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/nanopack/logvac/core"
+	"github.com/nanopack/logvac/drain"
+)
+
+const (
+	followTimeout    = 30  // seconds to wait for new logs by default
+	followTimeoutMax = 120 // max seconds a client may wait for new logs
+)
+
+// followLogs waits for logs matching the (forward) query to be archived. It
+// responds with them as soon as there are any, or with none once the timeout
+// passes, along with the cursor to follow next.
+func followLogs(res http.ResponseWriter, req *http.Request, archive drain.ArchiverDrain, query drain.Query, timeout time.Duration) {
+	expired := time.After(timeout)
+	var closed <-chan bool
+	if notifier, ok := res.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+
+	var logs []logvac.Message
+	for {
+		// watch for writes before reading, so none are missed in between
+		written := archive.Notify(query.Type)
+
+		var err error
+		logs, err = archive.Slice(query)
+		if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte(err.Error()))
+			return
+		}
+		if len(logs) != 0 {
+			break
+		}
+
+		select {
+		case <-written:
+			continue
+		case <-expired:
+		case <-closed:
+			return
+		}
+		break
+	}
+
+	body, err := json.Marshal(newPage(logs, query))
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	res.WriteHeader(200)
+	res.Write(append(body, byte('\n')))
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nanopack/logvac/config"
+	"github.com/nanopack/logvac/core"
+	"github.com/nanopack/logvac/drain"
+)
+
+// histogram responds with the number of logs matching the filters per interval
+// of time (and per level, id, or tag if grouped), for graphing log volume
+func histogram(rw http.ResponseWriter, req *http.Request) {
+	// /logs/histogram?type=app&interval=1m&from=&to=&group=level|id|tag&id=&tag=&level=&maxlevel=
+	query := req.URL.Query()
+
+	kind := query.Get("type")
+	if kind == "" {
+		kind = config.LogType
+	}
+
+	interval := query.Get("interval")
+	if interval == "" {
+		interval = "1m"
+	}
+	period, err := drain.ParsePeriod(interval)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(fmt.Sprintf("bad interval '%s' (X(s)ec, (m)in, (h)our, (d)ay, (w)eek)", interval)))
+		return
+	}
+
+	group := query.Get("group")
+	if !drain.ValidGroup(group) {
+		rw.WriteHeader(400)
+		rw.Write([]byte("bad group (level|id|tag)"))
+		return
+	}
+
+	var from, to int64
+	if f := query.Get("from"); f != "" {
+		if from, err = drain.ParseTime(f); err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte("bad from time"))
+			return
+		}
+	}
+	to = time.Now().UnixNano()
+	if t := query.Get("to"); t != "" {
+		if to, err = drain.ParseTime(t); err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte("bad to time"))
+			return
+		}
+	}
+	if from > to {
+		rw.WriteHeader(400)
+		rw.Write([]byte("bad time range (from is after to)"))
+		return
+	}
+
+	level, levels, err := parseLevels(query.Get("level"), query.Get("maxlevel"))
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	if drain.Archiver == nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte("no archive configured"))
+		return
+	}
+
+	filter := drain.Query{
+		Type:   kind,
+		Id:     query["id"],
+		Tag:    query["tag"],
+		Start:  to,
+		End:    from,
+		Level:  level,
+		Levels: levels,
+	}
+
+	// the histogram starts at the oldest matching log by default, so find it
+	// to check the number of intervals before counting everything
+	if from == 0 {
+		oldest := filter
+		oldest.Limit = 1
+		oldest.Forward = true
+		err = drain.Archiver.Walk(oldest, func(msg logvac.Message) error {
+			from = msg.UTime
+			return nil
+		})
+		if err != nil {
+			rw.WriteHeader(500)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+		// no logs to count
+		if from == 0 {
+			rw.WriteHeader(200)
+			rw.Write([]byte("[]\n"))
+			return
+		}
+		filter.End = from
+	}
+	if (to-from)/period >= drain.HistogramMax {
+		rw.WriteHeader(400)
+		rw.Write([]byte(fmt.Sprintf("too many intervals (max %d), use a longer interval or a later from time", drain.HistogramMax)))
+		return
+	}
+
+	buckets, err := drain.Archiver.Histogram(filter, period, group)
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	body, err := json.Marshal(buckets)
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.WriteHeader(200)
+	rw.Write(append(body, byte('\n')))
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/nanopack/logvac/drain"
+)
+
+// placeHold keeps the logs a hold describes from being expired or purged
+func placeHold(rw http.ResponseWriter, req *http.Request) {
+	hold := drain.Hold{}
+
+	err := parseBody(req, &hold)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(fmt.Sprintf("Failed to parse hold - %s", err.Error())))
+		return
+	}
+	hold.By = req.RemoteAddr
+
+	placed, err := drain.PlaceHold(hold)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(fmt.Sprintf("Failed to place hold - %s", err.Error())))
+		return
+	}
+
+	body, err := json.Marshal(placed)
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.WriteHeader(200)
+	rw.Write(append(body, byte('\n')))
+}
+
+func listHolds(rw http.ResponseWriter, req *http.Request) {
+	holds, err := drain.Holds()
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	body, err := json.Marshal(holds)
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.WriteHeader(200)
+	rw.Write(append(body, byte('\n')))
+}
+
+func releaseHold(rw http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+
+	err := drain.ReleaseHold(id)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(fmt.Sprintf("Failed to release hold - %s", err.Error())))
+		return
+	}
+
+	rw.WriteHeader(200)
+	rw.Write([]byte("success!\n"))
+}
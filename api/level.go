@@ -0,0 +1,89 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nanopack/logvac/drain"
+)
+
+const maxLevel = drain.MaxLevel
+
+// parseLevel converts a level name (or priority) to a priority
+func parseLevel(level string) (int, error) {
+	priority, ok := drain.ParseLevel(level)
+	if !ok {
+		return 0, fmt.Errorf("bad level '%s' (trace|debug|info|warn|error|fatal)", level)
+	}
+	return priority, nil
+}
+
+// parseLevels converts the `level` (a minimum "warn", a range "warn..error", or
+// a list "error,fatal") and `maxlevel` parameters to a minimum priority and the
+// priorities allowed (nil allows any above the minimum)
+func parseLevels(level, max string) (int, []int, error) {
+	var err error
+	low, high := 0, maxLevel
+	var only []int
+
+	switch {
+	case strings.Contains(level, ".."):
+		bounds := strings.SplitN(level, "..", 2)
+		// either end may be left open
+		if bounds[0] != "" {
+			if low, err = parseLevel(bounds[0]); err != nil {
+				return 0, nil, err
+			}
+		}
+		if bounds[1] != "" {
+			if high, err = parseLevel(bounds[1]); err != nil {
+				return 0, nil, err
+			}
+		}
+	case strings.Contains(level, ","):
+		for _, name := range strings.Split(level, ",") {
+			priority, err := parseLevel(name)
+			if err != nil {
+				return 0, nil, err
+			}
+			only = append(only, priority)
+		}
+	case level != "":
+		if low, err = parseLevel(level); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if max != "" {
+		priority, err := parseLevel(max)
+		if err != nil {
+			return 0, nil, err
+		}
+		if priority < high {
+			high = priority
+		}
+	}
+	if low > high {
+		return 0, nil, fmt.Errorf("bad level range '%s' (minimum is above maximum)", level)
+	}
+
+	if only != nil {
+		allowed := []int{}
+		for _, priority := range only {
+			if priority <= high {
+				allowed = append(allowed, priority)
+			}
+		}
+		// an empty list would match every level
+		if len(allowed) == 0 {
+			return 0, nil, fmt.Errorf("bad levels '%s' (all are above the maximum '%s')", level, max)
+		}
+		return 0, allowed, nil
+	}
+	if high < maxLevel {
+		for priority := low; priority <= high; priority++ {
+			only = append(only, priority)
+		}
+	}
+	return low, only, nil
+}
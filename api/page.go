@@ -0,0 +1,54 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/nanopack/logvac/core"
+	"github.com/nanopack/logvac/drain"
+)
+
+type (
+	// page is the enveloped response to a request for logs
+	page struct {
+		Logs []logvac.Message `json:"logs"`
+		Next string           `json:"next,omitempty"` // cursor to the logs after these
+		Prev string           `json:"prev,omitempty"` // cursor to the logs before these
+	}
+
+	// position is where a cursor continues reading from
+	position struct {
+		Forward bool  `json:"f,omitempty"`
+		UTime   int64 `json:"t"`
+	}
+)
+
+// newPage envelopes logs with cursors to the logs before and after them. Pages
+// read forward always have a next cursor, so new logs can be polled for.
+func newPage(logs []logvac.Message, query drain.Query) page {
+	p := page{Logs: logs}
+	if len(logs) != 0 {
+		p.Prev = encodeCursor(position{UTime: logs[0].UTime - 1})
+		p.Next = encodeCursor(position{Forward: true, UTime: logs[len(logs)-1].UTime + 1})
+	} else if query.Forward {
+		p.Next = encodeCursor(position{Forward: true, UTime: query.End})
+	}
+	return p
+}
+
+// encodeCursor returns the opaque cursor of a position
+func encodeCursor(pos position) string {
+	b, _ := json.Marshal(pos)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor returns the position of a cursor
+func decodeCursor(cursor string) (position, error) {
+	pos := position{}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return pos, err
+	}
+	err = json.Unmarshal(b, &pos)
+	return pos, err
+}
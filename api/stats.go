@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/nanopack/logvac/collector"
+	"github.com/nanopack/logvac/core"
+	"github.com/nanopack/logvac/drain"
+)
+
+func redactStats(rw http.ResponseWriter, req *http.Request) {
+	body, err := json.Marshal(logvac.RedactStats())
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.WriteHeader(200)
+	rw.Write(append(body, byte('\n')))
+}
+
+func sizeStats(rw http.ResponseWriter, req *http.Request) {
+	body, err := json.Marshal(collector.OversizeStats())
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.WriteHeader(200)
+	rw.Write(append(body, byte('\n')))
+}
+
+func archiveStats(rw http.ResponseWriter, req *http.Request) {
+	// number of ids logging the most to list per type
+	top := 10
+	if t := req.URL.Query().Get("top"); t != "" {
+		var err error
+		top, err = strconv.Atoi(t)
+		if err != nil || top < 0 {
+			rw.WriteHeader(400)
+			rw.Write([]byte("bad top count"))
+			return
+		}
+	}
+
+	stats, err := drain.Stats(top)
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	body, err := json.Marshal(stats)
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.WriteHeader(200)
+	rw.Write(append(body, byte('\n')))
+}
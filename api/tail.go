@@ -0,0 +1,205 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/nanopack/logvac/config"
+	"github.com/nanopack/logvac/core"
+	"github.com/nanopack/logvac/drain"
+)
+
+const (
+	tailBuffer    = 1000             // logs buffered per client before dropping
+	tailKeepalive = 30 * time.Second // how often idle connections are pinged
+)
+
+// tails counts live tails, to give each its own drain
+var tails uint64
+
+// tail streams new logs matching the filters (type, id, tag, level) to the
+// client as they arrive, over a websocket if requested or server-sent events.
+// The last `replay` archived logs are sent first.
+func tail(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	kind := query.Get("type")
+	if kind == "" {
+		kind = config.LogType
+	}
+	level, levels, err := parseLevels(query.Get("level"), query.Get("maxlevel"))
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	filter := drain.Query{
+		Type:   kind,
+		Id:     query["id"],
+		Tag:    query["tag"],
+		Level:  level,
+		Levels: levels,
+	}
+
+	var replay int64
+	if r := query.Get("replay"); r != "" {
+		replay, err = strconv.ParseInt(r, 10, 64)
+		if err != nil || replay < 0 {
+			rw.WriteHeader(400)
+			rw.Write([]byte("bad replay count"))
+			return
+		}
+	}
+
+	// start listening before replaying, so no logs are missed in between
+	logs := make(chan logvac.Message, tailBuffer)
+	var dropped uint64
+	tag := fmt.Sprintf("tail-%d", atomic.AddUint64(&tails, 1))
+	logvac.AddDrain(tag, func(msg logvac.Message) {
+		if !filter.MatchType(msg.Type) || !filter.Match(msg) {
+			return
+		}
+		// never hold up other drains for a slow client
+		select {
+		case logs <- msg:
+		default:
+			atomic.AddUint64(&dropped, 1)
+		}
+	})
+	defer logvac.RemoveDrain(tag)
+
+	var history []logvac.Message
+	if replay > 0 && drain.Archiver != nil {
+		replayed := filter
+		replayed.Limit = replay
+		replayed.ScanLimit = int64(config.ScanLimit)
+		history, err = drain.Archiver.Slice(replayed)
+		if err != nil {
+			rw.WriteHeader(500)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	var send func(msg logvac.Message) error
+	var closed <-chan bool
+	var ping func() error
+
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		upgrader := websocket.Upgrader{CheckOrigin: allowedOrigin}
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			// upgrader already responded
+			config.Log.Debug("Failed to upgrade tail - %s", err)
+			return
+		}
+		defer conn.Close()
+
+		send = func(msg logvac.Message) error {
+			return conn.WriteJSON(msg)
+		}
+		ping = func() error {
+			return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(tailKeepalive))
+		}
+
+		// the client doesn't send anything, read to notice it leaving
+		done := make(chan bool)
+		go func() {
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					close(done)
+					return
+				}
+			}
+		}()
+		closed = done
+	} else {
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			rw.WriteHeader(500)
+			rw.Write([]byte("streaming unsupported"))
+			return
+		}
+
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Header().Set("Cache-Control", "no-cache")
+		rw.WriteHeader(200)
+		flusher.Flush()
+
+		send = func(msg logvac.Message) error {
+			body, err := json.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			if _, err = fmt.Fprintf(rw, "data: %s\n\n", body); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}
+		ping = func() error {
+			if _, err := rw.Write([]byte(": keepalive\n\n")); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}
+
+		done := make(chan bool)
+		if notifier, ok := rw.(http.CloseNotifier); ok {
+			go func() {
+				<-notifier.CloseNotify()
+				close(done)
+			}()
+		}
+		closed = done
+	}
+
+	// replay history, then skip live logs already sent
+	var newest int64
+	for i := range history {
+		if err := send(history[i]); err != nil {
+			return
+		}
+		newest = history[i].UTime
+	}
+
+	keepalive := time.NewTicker(tailKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case msg := <-logs:
+			if msg.UTime <= newest {
+				continue
+			}
+			if err := send(msg); err != nil {
+				config.Log.Debug("Tail closed - %s", err)
+				return
+			}
+		case <-keepalive.C:
+			if n := atomic.SwapUint64(&dropped, 0); n != 0 {
+				config.Log.Debug("Tail '%s' too slow, dropped %d logs", tag, n)
+			}
+			if err := ping(); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// allowedOrigin returns true if a websocket request's origin is allowed by
+// the 'cors-allow' setting
+func allowedOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	return config.CorsAllow == "*" || origin == "" || origin == config.CorsAllow
+}
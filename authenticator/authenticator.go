@@ -7,6 +7,8 @@ import (
 	"io"
 	"net/url"
 
+	"github.com/boltdb/bolt"
+
 	"github.com/nanopack/logvac/config"
 )
 
@@ -29,12 +31,9 @@ var (
 
 // Init initializes the chosen authenticator
 func Init() error {
-	u, err := url.Parse(config.AuthAddress)
+	u, err := authURL()
 	if err != nil {
-		u, err = url.Parse("boltdb://" + config.AuthAddress)
-		if err != nil {
-			return fmt.Errorf("Failed to parse auth connection - %s", err)
-		}
+		return err
 	}
 	switch u.Scheme {
 	case "boltdb":
@@ -110,3 +109,40 @@ func ImportLogvac(importReader io.Reader) error {
 	config.Log.Trace("Importing tokens...")
 	return authenticator.importLogvac(importReader)
 }
+
+// Snapshot calls fn with a read transaction on the boltdb authenticator's db
+// (other authenticators have nothing to snapshot)
+func Snapshot(fn func(tx *bolt.Tx) error) error {
+	b, ok := authenticator.(*boltdb)
+	if !ok {
+		return nil
+	}
+	config.Log.Trace("Snapshotting tokens...")
+	return b.snapshot(fn)
+}
+
+// SnapshotPath returns where a snapshot of the boltdb authenticator's db is
+// restored to, or "" if 'auth-address' isn't a boltdb
+func SnapshotPath() (string, error) {
+	u, err := authURL()
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "boltdb", "file":
+		return u.Path, nil
+	}
+	return "", nil
+}
+
+// authURL parses 'auth-address'
+func authURL() (*url.URL, error) {
+	u, err := url.Parse(config.AuthAddress)
+	if err != nil {
+		u, err = url.Parse("boltdb://" + config.AuthAddress)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse auth connection - %s", err)
+		}
+	}
+	return u, nil
+}
@@ -62,6 +62,20 @@ func (b boltdb) initialize() error {
 	return nil
 }
 
+func (b boltdb) snapshot(fn func(tx *bolt.Tx) error) error {
+	if b.dbAddr == "" {
+		return errors.New("I need to be setup first")
+	}
+
+	db, err := bolt.Open(b.dbAddr, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(fn)
+}
+
 func (b boltdb) add(token string) error {
 	if b.dbAddr == "" {
 		return errors.New("I need to be setup first")
@@ -2,17 +2,40 @@
 package collector
 
 import (
+	"fmt"
 	"net/http"
+	"sync/atomic"
+	"unicode/utf8"
 
 	"github.com/nanopack/logvac/config"
+	"github.com/nanopack/logvac/core"
+)
+
+type (
+	// SizeStats counts the messages a listener received over its size limit
+	SizeStats struct {
+		Dropped   uint64 `json:"dropped"`
+		Truncated uint64 `json:"truncated"`
+	}
 )
 
 var (
 	// CollectHandler handles the posting of logs via http. It is passed to
 	// the api on start.
 	CollectHandler http.HandlerFunc
+
+	// oversized counts messages over the size limit per listener
+	oversized = map[string]*SizeStats{
+		"http": &SizeStats{},
+		"tcp":  &SizeStats{},
+		"udp":  &SizeStats{},
+	}
 )
 
+// headerSize is the room allowed for syslog headers or the json envelope on
+// top of a listener's max message size
+const headerSize = 4096
+
 // Init initializes the tcp, udp, and http servers, if configured
 func Init() error {
 	// todo: handle similar to mist listeners
@@ -39,3 +62,76 @@ func Init() error {
 
 	return nil
 }
+
+// maxSize returns the max message size (bytes) for a listener (0 is unlimited)
+func maxSize(listener string) int {
+	max := config.MaxSize
+	switch listener {
+	case "http":
+		if config.MaxSizeHttp > 0 {
+			max = config.MaxSizeHttp
+		}
+	case "tcp":
+		if config.MaxSizeTcp > 0 {
+			max = config.MaxSizeTcp
+		}
+	case "udp":
+		if config.MaxSizeUdp > 0 {
+			max = config.MaxSizeUdp
+		}
+	}
+	return max
+}
+
+// limitSize enforces the listener's max message size on the message's content.
+// It returns false if the message should be rejected, otherwise oversized
+// content gets truncated with a marker and the number of bytes cut is recorded
+// on the message. `cut` is the number of bytes already discarded while reading.
+func limitSize(listener string, msg *logvac.Message, cut int) bool {
+	max := maxSize(listener)
+	if max <= 0 || (cut == 0 && len(msg.Content) <= max) {
+		return true
+	}
+
+	if config.OversizeAction == "reject" {
+		atomic.AddUint64(&oversized[listener].Dropped, 1)
+		config.Log.Debug("Dropped %d byte message from %s listener (max %d)", len(msg.Content)+cut, listener, max)
+		return false
+	}
+
+	truncate(msg, max, cut)
+	atomic.AddUint64(&oversized[listener].Truncated, 1)
+	return true
+}
+
+// truncate cuts the message's content to max bytes (on a utf8 boundary) and
+// marks it as truncated
+func truncate(msg *logvac.Message, max, cut int) {
+	if len(msg.Content) > max {
+		end := max
+		for end > 0 && !utf8.RuneStart(msg.Content[end]) {
+			end--
+		}
+		cut += len(msg.Content) - end
+		msg.Content = msg.Content[:end]
+	}
+	if len(msg.Raw) > max+headerSize {
+		msg.Raw = msg.Raw[:max+headerSize]
+	}
+
+	msg.Truncated = cut
+	msg.Content += fmt.Sprintf("...[truncated %d bytes]", cut)
+}
+
+// OversizeStats returns the number of oversized messages dropped or truncated
+// per listener
+func OversizeStats() map[string]SizeStats {
+	stats := make(map[string]SizeStats, len(oversized))
+	for listener, count := range oversized {
+		stats[listener] = SizeStats{
+			Dropped:   atomic.LoadUint64(&count.Dropped),
+			Truncated: atomic.LoadUint64(&count.Truncated),
+		}
+	}
+	return stats
+}
@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -148,6 +149,91 @@ func TestGetLogs(t *testing.T) {
 	}
 }
 
+// test truncating and rejecting oversized messages
+func TestOversize(t *testing.T) {
+	config.MaxSize = 1024
+	config.MaxSizeHttp = 16
+	defer func() {
+		config.MaxSize = 0
+		config.MaxSizeHttp = 0
+		config.OversizeAction = "truncate"
+	}()
+
+	body, err := rest("POST", "/logs", "{\"id\":\"log-test\",\"type\":\"oversize\",\"message\":\"this message is too long\"}")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if string(body) != "success!\n" {
+		t.Errorf("%q doesn't match expected out", body)
+		t.FailNow()
+	}
+
+	config.OversizeAction = "reject"
+	_, err = rest("POST", "/logs", "{\"id\":\"log-test\",\"type\":\"oversize\",\"message\":\"this message is too long\"}")
+	if err == nil || !strings.Contains(err.Error(), "413") {
+		t.Errorf("oversized message is too forgiving - %v", err)
+	}
+	_, err = rest("POST", "/logs", strings.Repeat("a", 16+5000))
+	if err == nil || !strings.Contains(err.Error(), "413") {
+		t.Errorf("oversized body is too forgiving - %v", err)
+	}
+	// bodies too large to hold a max sized message are truncated too
+	config.OversizeAction = "truncate"
+	if _, err = rest("POST", "/logs", strings.Repeat("b", 16+5000)); err != nil {
+		t.Error(err)
+	}
+	// (json keeping its fields)
+	big := fmt.Sprintf("{\"id\":\"big\",\"type\":\"bigjson\",\"tag\":[\"huge\"],\"priority\":4,\"message\":\"%s\"}", strings.Repeat("c", 16+5000))
+	if _, err = rest("POST", "/logs", big); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(time.Second)
+
+	body, err = rest("GET", "/logs?type=bigjson", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	parsed := []logvac.Message{}
+	json.Unmarshal(body, &parsed)
+	if len(parsed) != 1 || parsed[0].Id != "big" || len(parsed[0].Tag) != 1 || parsed[0].Tag[0] != "huge" || parsed[0].Priority != 4 ||
+		parsed[0].Content != strings.Repeat("c", 16)+"...[truncated 5000 bytes]" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	body, err = rest("GET", "/logs?type=app&q=bbbb", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	raw := []logvac.Message{}
+	json.Unmarshal(body, &raw)
+	if len(raw) != 1 || raw[0].Content != strings.Repeat("b", 16)+"...[truncated 5000 bytes]" || raw[0].Truncated != 5000 {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	body, err = rest("GET", "/logs?type=oversize", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	msg := []logvac.Message{}
+	err = json.Unmarshal(body, &msg)
+	if err != nil {
+		t.Error(fmt.Errorf("Failed to unmarshal - %s", err))
+		t.FailNow()
+	}
+	if len(msg) != 1 || msg[0].Content != "this message is ...[truncated 8 bytes]" || msg[0].Truncated != 8 {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	stats := collector.OversizeStats()
+	if stats["http"].Truncated != 3 || stats["http"].Dropped != 2 {
+		t.Errorf("%+v doesn't match expected stats", stats)
+	}
+}
+
 // hit api and return response body
 func rest(method, route, data string) ([]byte, error) {
 	body := bytes.NewBuffer([]byte(data))
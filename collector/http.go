@@ -8,28 +8,76 @@ package collector
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/nanopack/logvac/config"
 	"github.com/nanopack/logvac/core"
 )
 
+// httpBodyCap is the most of an oversized body read to be truncated (more is
+// cut unparsed, as raw content)
+const httpBodyCap = 8 << 20
+
 // GenerateHttpCollector creates and returns an http handler that can be dropped into the api.
 func GenerateHttpCollector() http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
-		body, err := ioutil.ReadAll(req.Body)
+		// read no more than can hold a message of the max size, unless truncating
+		var reader io.Reader = req.Body
+		max := maxSize("http")
+		if max > 0 {
+			reader = io.LimitReader(req.Body, int64(max+headerSize+1))
+		}
+
+		body, err := ioutil.ReadAll(reader)
 		if err != nil {
 			res.WriteHeader(500)
 			return
 		}
+		cut := 0
+		if max > 0 && len(body) > max+headerSize {
+			if config.OversizeAction == "reject" {
+				atomic.AddUint64(&oversized["http"].Dropped, 1)
+				res.WriteHeader(413)
+				res.Write([]byte(fmt.Sprintf("Message too large (max %d bytes)\n", max)))
+				return
+			}
+
+			// read the rest (up to a cap) so the json can be parsed and its
+			// message truncated
+			limit := httpBodyCap
+			if limit < max+headerSize {
+				limit = max + headerSize
+			}
+			rest, err := ioutil.ReadAll(io.LimitReader(req.Body, int64(limit+1-len(body))))
+			if err != nil {
+				res.WriteHeader(500)
+				return
+			}
+			body = append(body, rest...)
+
+			// beyond the cap, keep what fits, discarding the rest unbuffered
+			if len(body) > limit {
+				extra, err := io.Copy(ioutil.Discard, req.Body)
+				if err != nil {
+					res.WriteHeader(500)
+					return
+				}
+				cut = len(body) - (max + headerSize) + int(extra)
+				body = body[:max+headerSize]
+			}
+		}
 
 		var msg logvac.Message
 		err = json.Unmarshal(body, &msg)
 		if err != nil {
-			if !strings.Contains(err.Error(), "invalid character") {
+			// a cut body can't be json, it's kept as raw content
+			if cut == 0 && !strings.Contains(err.Error(), "invalid character") {
 				res.WriteHeader(500)
 				res.Write([]byte(err.Error()))
 				return
@@ -46,6 +94,13 @@ func GenerateHttpCollector() http.HandlerFunc {
 		}
 		msg.Time = time.Now()
 		msg.UTime = msg.Time.UnixNano()
+		msg.Token = userToken(req)
+
+		if !limitSize("http", &msg, cut) {
+			res.WriteHeader(413)
+			res.Write([]byte(fmt.Sprintf("Message too large (max %d bytes)\n", max)))
+			return
+		}
 
 		// config.Log.Trace("Message: %q", msg)
 		logvac.WriteMessage(msg)
@@ -54,3 +109,16 @@ func GenerateHttpCollector() http.HandlerFunc {
 		res.Write([]byte("success!\n"))
 	}
 }
+
+// userToken returns the 'X-USER-TOKEN' the request was made with
+func userToken(req *http.Request) string {
+	token := req.Header.Get("X-USER-TOKEN")
+	if token == "" {
+		query := req.URL.Query()
+		token = query.Get("X-USER-TOKEN")
+		if token == "" {
+			token = query.Get("x-user-token")
+		}
+	}
+	return token
+}
@@ -2,6 +2,7 @@ package collector
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 	"net"
 	"strings"
@@ -46,12 +47,9 @@ func SyslogUDPStart(address string) error {
 		return err
 	}
 	go func() {
+		// large enough for any udp packet (size limits are enforced after parsing)
+		buf := make([]byte, 65536)
 		for {
-			// if data is missing, a network protocol is being used that sends more
-			// data than 2048 bytes. For syslog and nc, this is sufficient.
-			var buf []byte = make([]byte, 2048)
-
-			// read 2048 bytes from the udp packet
 			n, remote, err := socket.ReadFromUDP(buf)
 			if err != nil {
 				return
@@ -59,13 +57,20 @@ func SyslogUDPStart(address string) error {
 			if remote != nil {
 				// if the number of bytes read is greater than 0
 				if n > 0 {
+					// copy the packet so the buffer can be reused
+					data := make([]byte, n)
+					copy(data, buf[:n])
+
 					// handle parsing in another process so that this one can continue to
 					// receive UDP packets
-					go func(buf []byte) {
-						msg := parseMessage(buf[0:n])
+					go func(data []byte) {
+						msg := parseMessage(data)
 						msg.Type = config.LogType
+						if !limitSize("udp", &msg, 0) {
+							return
+						}
 						logvac.WriteMessage(msg)
-					}(buf)
+					}(data)
 				}
 			}
 		}
@@ -97,8 +102,14 @@ func SyslogTCPStart(address string) error {
 func handleConnection(conn net.Conn) {
 	r := bufio.NewReader(conn)
 
+	// don't buffer lines too large to hold a message of the max size
+	max := maxSize("tcp")
+	if max > 0 {
+		max += headerSize
+	}
+
 	for {
-		line, err := r.ReadString('\n')
+		line, cut, err := readLine(r, max)
 		if err != nil && err != io.EOF {
 			// some unexpected error happened
 			return
@@ -110,10 +121,41 @@ func handleConnection(conn net.Conn) {
 		}
 		msg := parseMessage([]byte(line))
 		msg.Type = config.LogType
+		if !limitSize("tcp", &msg, cut) {
+			continue
+		}
 		logvac.WriteMessage(msg)
 	}
 }
 
+// readLine reads a line, keeping at most max bytes (0 is unlimited) and
+// returning the number of bytes discarded
+func readLine(r *bufio.Reader, max int) (string, int, error) {
+	if max <= 0 {
+		line, err := r.ReadString('\n')
+		return line, 0, err
+	}
+
+	var line []byte
+	cut := 0
+	for {
+		chunk, err := r.ReadSlice('\n')
+		keep := max - len(line)
+		if keep > len(chunk) {
+			keep = len(chunk)
+		}
+		line = append(line, chunk[:keep]...)
+		cut += len(chunk) - keep
+		if err != bufio.ErrBufferFull {
+			// the newline isn't part of the message
+			if cut > 0 && bytes.HasSuffix(chunk, []byte("\n")) {
+				cut--
+			}
+			return string(line), cut, err
+		}
+	}
+}
+
 // parseMessage parses the syslog message and returns a msg
 // if the msg is not parsable or a standard formatted syslog message
 // it will drop the whole message into the content and make up a timestamp
@@ -17,16 +17,17 @@ var (
 	ListenTcp  = "127.0.0.1:6361" // address the tcp log collector listens on
 
 	// drains
-	PubAddress = ""                             // publisher address // mist://127.0.0.1:1445
-	PubAuth    = ""                             // publisher auth token
-	DbAddress  = "boltdb:///var/db/logvac.bolt" // database address
+	PubAddress  = ""                             // publisher address // mist://127.0.0.1:1445
+	PubAuth     = ""                             // publisher auth token
+	DbAddress   = "boltdb:///var/db/logvac.bolt" // database address
+	ColdAddress = ""                             // cold storage logs are offloaded to before expiring // s3://key:secret@s3.amazonaws.com/bucket/prefix?region=us-east-1
 
 	// authenticator
 	AuthAddress = "boltdb:///var/db/log-auth.bolt" // address or file location of auth backend ('boltdb:///var/db/logvac.bolt' or 'postgresql://127.0.0.1')
 
 	// other
 	CorsAllow = "*"            // sets `Access-Control-Allow-Origin` header
-	LogKeep   = `{"app":"2w"}` // LogType and expire (X(m)in, (h)our,  (d)ay, (w)eek, (y)ear) (1, 10, 100 == keep up to that many) // todo: maybe map[string]interface
+	LogKeep   = `{"app":"2w"}` // LogType and expire (X(m)in, (h)our,  (d)ay, (w)eek, (y)ear) (1, 10, 100 == keep up to that many) (or {"max_age", "max_count", "max_bytes", "levels"} rules; "*" for other types)
 	LogType   = "app"          // default incoming log type when not set
 	LogLevel  = "info"         // level which logvac will log at
 	Token     = "secret"       // token to connect to logvac's api
@@ -35,6 +36,30 @@ var (
 	Server    = false          // whether or not to start logvac as a server
 	Version   = false          // whether or not to print version info and exit
 	CleanFreq = 60             // how often to clean log database
+	ScanLimit = 1000000        // max logs examined per request when fetching (0 is unlimited)
+	Partition = "1d"           // period of time each archive file holds per type (X(s)ec, (m)in, (h)our, (d)ay, (w)eek) ("" archives to a single file)
+
+	// redaction
+	Redact        = ""           // custom redaction rules '{"password":"password=(\\S+)"}' (only the first capture group is masked, if any)
+	RedactBuiltin = ""           // built-in redaction detectors to enable (credit-card,bearer-token,aws-key)
+	RedactMask    = "[REDACTED]" // replacement for redacted data
+
+	// rate limiting
+	RateLimit       = "" // token-bucket limits '[{"by":"id","rate":100,"burst":500,"action":"drop|sample|downgrade","sample":10,"type":"throttled"}]'
+	RateLimitReport = 60 // how often (seconds) to log a summary of rate limited messages
+
+	// deduplication
+	DedupWindow = 0 // window (seconds) within which identical messages from a source are collapsed (0 disables)
+
+	// message size
+	MaxSize        = 0          // max size (bytes) of a message's content (0 is unlimited)
+	MaxSizeHttp    = 0          // max message size for the http collector (overrides MaxSize)
+	MaxSizeTcp     = 0          // max message size for the tcp collector (overrides MaxSize)
+	MaxSizeUdp     = 0          // max message size for the udp collector (overrides MaxSize)
+	OversizeAction = "truncate" // what to do with oversized messages (truncate|reject)
+
+	// backups
+	RestoreBackup = "" // backup (from /admin/backup) to replace the archive, drain config, and auth dbs with before starting
 )
 
 // AddFlags adds cli flags to logvac
@@ -48,13 +73,14 @@ func AddFlags(cmd *cobra.Command) {
 	cmd.Flags().StringVarP(&PubAddress, "pub-address", "p", PubAddress, "Log publisher (mist) address (\"mist://127.0.0.1:1445\")")
 	cmd.Flags().StringVarP(&PubAuth, "pub-auth", "P", PubAuth, "Log publisher (mist) auth token")
 	cmd.Flags().StringVarP(&DbAddress, "db-address", "d", DbAddress, "Log storage address")
+	cmd.Flags().StringVar(&ColdAddress, "cold-address", ColdAddress, "S3-compatible storage to offload logs to before expiring them ('s3://key:secret@host/bucket/prefix?region=us-east-1')")
 
 	// authenticator
 	cmd.PersistentFlags().StringVarP(&AuthAddress, "auth-address", "A", AuthAddress, "Address or file location of authentication db. ('boltdb:///var/db/logvac.bolt' or 'postgresql://127.0.0.1')")
 
 	// other
 	cmd.Flags().StringVarP(&CorsAllow, "cors-allow", "C", CorsAllow, "Sets the 'Access-Control-Allow-Origin' header")
-	cmd.Flags().StringVarP(&LogKeep, "log-keep", "k", LogKeep, "Age or number of logs to keep per type '{\"app\":\"2w\", \"deploy\": 10}' (int or X(m)in, (h)our,  (d)ay, (w)eek, (y)ear)")
+	cmd.Flags().StringVarP(&LogKeep, "log-keep", "k", LogKeep, "Age or number of logs to keep per type '{\"app\":\"2w\", \"deploy\": 10}' (int or X(m)in, (h)our,  (d)ay, (w)eek, (y)ear, or rules; see README)")
 	cmd.Flags().StringVarP(&LogLevel, "log-level", "l", LogLevel, "Level at which to log")
 	cmd.Flags().StringVarP(&LogType, "log-type", "L", LogType, "Default type to apply to incoming logs (commonly used: app|deploy)")
 	cmd.Flags().StringVarP(&Token, "token", "T", Token, "Administrative token to add/remove 'X-USER-TOKEN's used to pub/sub via http")
@@ -63,6 +89,30 @@ func AddFlags(cmd *cobra.Command) {
 	cmd.Flags().BoolVarP(&Version, "version", "v", Version, "Print version info and exit")
 	cmd.Flags().IntVar(&CleanFreq, "clean-frequency", CleanFreq, "How often to clean log database")
 	cmd.Flags().MarkHidden("clean-frequency")
+	cmd.Flags().IntVar(&ScanLimit, "scan-limit", ScanLimit, "Max logs examined per request when fetching logs (0 is unlimited)")
+	cmd.Flags().StringVar(&Partition, "partition", Partition, "Period of time each archive file holds per type (X(m)in, (h)our, (d)ay, (w)eek) ('' archives to a single file)")
+
+	// redaction
+	cmd.Flags().StringVar(&Redact, "redact", Redact, "Regex rules to redact from logs before storing/draining '{\"password\":\"password=(\\\\S+)\"}'")
+	cmd.Flags().StringVar(&RedactBuiltin, "redact-builtin", RedactBuiltin, "Built-in redaction detectors to enable (credit-card,bearer-token,aws-key)")
+	cmd.Flags().StringVar(&RedactMask, "redact-mask", RedactMask, "Replacement text for redacted data")
+
+	// rate limiting
+	cmd.Flags().StringVar(&RateLimit, "rate-limit", RateLimit, "Per id|token|type limits '[{\"by\":\"id\", \"rate\":100, \"burst\":500, \"action\":\"drop\"}]' (action: drop|sample|downgrade)")
+	cmd.Flags().IntVar(&RateLimitReport, "rate-limit-report", RateLimitReport, "How often (seconds) to log a summary of rate limited messages")
+
+	// deduplication
+	cmd.Flags().IntVar(&DedupWindow, "dedup-window", DedupWindow, "Window (seconds) within which identical messages from a source are collapsed (0 disables)")
+
+	// message size
+	cmd.Flags().IntVar(&MaxSize, "max-size", MaxSize, "Max size (bytes) of a message's content (0 is unlimited)")
+	cmd.Flags().IntVar(&MaxSizeHttp, "max-size-http", MaxSizeHttp, "Max message size for the http collector (overrides max-size)")
+	cmd.Flags().IntVar(&MaxSizeTcp, "max-size-tcp", MaxSizeTcp, "Max message size for the tcp collector (overrides max-size)")
+	cmd.Flags().IntVar(&MaxSizeUdp, "max-size-udp", MaxSizeUdp, "Max message size for the udp collector (overrides max-size)")
+	cmd.Flags().StringVar(&OversizeAction, "oversize-action", OversizeAction, "What to do with messages over the max size (truncate|reject)")
+
+	// backups
+	cmd.Flags().StringVar(&RestoreBackup, "restore-backup", RestoreBackup, "Backup (from /admin/backup) to replace the archive, drain config, and auth dbs with before starting")
 
 	Log = lumber.NewConsoleLogger(lumber.LvlInt("ERROR"))
 }
@@ -80,6 +130,7 @@ func ReadConfigFile(configFile string) error {
 	viper.SetDefault("pub-address", PubAddress)
 	viper.SetDefault("pub-auth", PubAuth)
 	viper.SetDefault("db-address", DbAddress)
+	viper.SetDefault("cold-address", ColdAddress)
 	viper.SetDefault("auth-address", AuthAddress)
 	viper.SetDefault("cors-allow", CorsAllow)
 	viper.SetDefault("log-keep", LogKeep)
@@ -88,6 +139,20 @@ func ReadConfigFile(configFile string) error {
 	viper.SetDefault("token", Token)
 	viper.SetDefault("server", Server)
 	viper.SetDefault("insecure", Insecure)
+	viper.SetDefault("scan-limit", ScanLimit)
+	viper.SetDefault("partition", Partition)
+	viper.SetDefault("redact", Redact)
+	viper.SetDefault("redact-builtin", RedactBuiltin)
+	viper.SetDefault("redact-mask", RedactMask)
+	viper.SetDefault("rate-limit", RateLimit)
+	viper.SetDefault("rate-limit-report", RateLimitReport)
+	viper.SetDefault("dedup-window", DedupWindow)
+	viper.SetDefault("max-size", MaxSize)
+	viper.SetDefault("max-size-http", MaxSizeHttp)
+	viper.SetDefault("max-size-tcp", MaxSizeTcp)
+	viper.SetDefault("max-size-udp", MaxSizeUdp)
+	viper.SetDefault("oversize-action", OversizeAction)
+	viper.SetDefault("restore-backup", RestoreBackup)
 
 	filename := filepath.Base(configFile)
 	viper.SetConfigName(filename[:len(filename)-len(filepath.Ext(filename))])
@@ -105,6 +170,7 @@ func ReadConfigFile(configFile string) error {
 	PubAddress = viper.GetString("pub-address")
 	PubAuth = viper.GetString("pub-auth")
 	DbAddress = viper.GetString("db-address")
+	ColdAddress = viper.GetString("cold-address")
 	AuthAddress = viper.GetString("auth-address")
 	CorsAllow = viper.GetString("cors-allow")
 	LogKeep = viper.GetString("log-keep")
@@ -113,6 +179,20 @@ func ReadConfigFile(configFile string) error {
 	Token = viper.GetString("token")
 	Server = viper.GetBool("server")
 	Insecure = viper.GetBool("insecure")
+	ScanLimit = viper.GetInt("scan-limit")
+	Partition = viper.GetString("partition")
+	Redact = viper.GetString("redact")
+	RedactBuiltin = viper.GetString("redact-builtin")
+	RedactMask = viper.GetString("redact-mask")
+	RateLimit = viper.GetString("rate-limit")
+	RateLimitReport = viper.GetInt("rate-limit-report")
+	DedupWindow = viper.GetInt("dedup-window")
+	MaxSize = viper.GetInt("max-size")
+	MaxSizeHttp = viper.GetInt("max-size-http")
+	MaxSizeTcp = viper.GetInt("max-size-tcp")
+	MaxSizeUdp = viper.GetInt("max-size-udp")
+	OversizeAction = viper.GetString("oversize-action")
+	RestoreBackup = viper.GetString("restore-backup")
 
 	return nil
 }
@@ -39,20 +39,27 @@ type (
 
 	// Message defines the structure of a log message
 	Message struct {
-		Time     time.Time `json:"time"`
-		UTime    int64     `json:"utime"`
-		Id       string    `json:"id"`   // ignoreifempty? // If setting multiple tags in id (syslog), set hostname first
-		Tag      []string  `json:"tag"`  // ignoreifempty?
-		Type     string    `json:"type"` // Can be set if logs are submitted via http (deploy logs)
-		Priority int       `json:"priority"`
-		Content  string    `json:"message"`
-		Raw      []byte    `json:"raw,omitempty"`
-		PubTries int       `json:"-"` // number of publish attempts
+		Time      time.Time `json:"time"`
+		UTime     int64     `json:"utime"`
+		Id        string    `json:"id"`   // ignoreifempty? // If setting multiple tags in id (syslog), set hostname first
+		Tag       []string  `json:"tag"`  // ignoreifempty?
+		Type      string    `json:"type"` // Can be set if logs are submitted via http (deploy logs)
+		Priority  int       `json:"priority"`
+		Content   string    `json:"message"`
+		Raw       []byte    `json:"raw,omitempty"`
+		PubTries  int       `json:"-"`                   // number of publish attempts
+		Token     string    `json:"-"`                   // 'X-USER-TOKEN' the message was submitted with (used for rate limiting)
+		Repeat    int       `json:"repeat,omitempty"`    // number of times the message was repeated (deduplicated)
+		Truncated int       `json:"truncated,omitempty"` // number of bytes cut from the message's content (over max size)
 	}
 
 	// Logvac defines the structure for the default logvac object
 	Logvac struct {
-		drains map[string]drainChannels
+		drains   map[string]drainChannels
+		dTex     sync.RWMutex  // drains' mutex
+		redactor *redactor     // scrubs secrets before messages reach any drain
+		limiter  *limiter      // rate limits noisy sources
+		deduper  *deduper      // collapses repeated messages
 	}
 
 	// Drain defines a third party log drain endpoint (generally, only raw logs get drained)
@@ -78,9 +85,34 @@ var Vac Logvac
 
 // Initializes a logvac object
 func Init() error {
+	// stop reporting for a previous instance
+	Vac.stop()
+
 	Vac = Logvac{
 		drains: make(map[string]drainChannels),
 	}
+
+	redactor, err := newRedactor()
+	if err != nil {
+		return fmt.Errorf("Failed to initialize redaction - %s", err)
+	}
+	Vac.redactor = redactor
+
+	limiter, err := newLimiter()
+	if err != nil {
+		return fmt.Errorf("Failed to initialize rate limiting - %s", err)
+	}
+	if limiter != nil {
+		Vac.limiter = limiter
+		go limiter.report(&Vac)
+	}
+
+	deduper := newDeduper()
+	if deduper != nil {
+		Vac.deduper = deduper
+		go deduper.flush(&Vac)
+	}
+
 	config.Log.Debug("Logvac initialized")
 	return nil
 }
@@ -91,8 +123,24 @@ func Close() {
 }
 
 func (l *Logvac) close() {
+	l.stop()
+	l.dTex.Lock()
+	defer l.dTex.Unlock()
 	for tag := range l.drains {
-		l.removeDrain(tag)
+		close(l.drains[tag].done)
+		delete(l.drains, tag)
+	}
+}
+
+// stop halts the background reporting of the ingest stages
+func (l *Logvac) stop() {
+	if l.limiter != nil {
+		l.limiter.close()
+		l.limiter = nil
+	}
+	if l.deduper != nil {
+		l.deduper.close()
+		l.deduper = nil
 	}
 }
 
@@ -119,7 +167,13 @@ func (l *Logvac) addDrain(tag string, drain DrainFunc) {
 		}
 	}()
 
+	l.dTex.Lock()
+	// drains may be added before Init
+	if l.drains == nil {
+		l.drains = make(map[string]drainChannels)
+	}
 	l.drains[tag] = channels
+	l.dTex.Unlock()
 }
 
 // RemoveDrain drops a drain
@@ -128,6 +182,8 @@ func RemoveDrain(tag string) {
 }
 
 func (l *Logvac) removeDrain(tag string) {
+	l.dTex.Lock()
+	defer l.dTex.Unlock()
 	_, ok := l.drains[tag]
 	if ok {
 		close(l.drains[tag].done)
@@ -144,7 +200,34 @@ func WriteMessage(msg Message) {
 
 func (l *Logvac) writeMessage(msg Message) {
 	// config.Log.Trace("Writing message - %s...", msg)
+	// scrub secrets before any drain sees the message
+	if l.redactor != nil {
+		msg = l.redactor.redact(msg)
+	}
+
+	// collapse repeats (before limiting, so they don't use up a source's allowance)
+	if l.deduper != nil {
+		ok, repeated := l.deduper.dedup(msg)
+		if repeated != nil {
+			l.broadcast(*repeated)
+		}
+		if !ok {
+			return
+		}
+	}
+
+	if l.limiter != nil && !l.limiter.limit(&msg) {
+		return
+	}
+
+	l.broadcast(msg)
+}
+
+// broadcast sends the message to all drains
+func (l *Logvac) broadcast(msg Message) {
 	group := sync.WaitGroup{}
+	l.dTex.RLock()
+	defer l.dTex.RUnlock()
 	for _, drain := range l.drains {
 		group.Add(1)
 		go func(myDrain drainChannels) {
@@ -0,0 +1,139 @@
+package logvac
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nanopack/logvac/config"
+)
+
+type (
+	// dedupEntry tracks the last distinct message of a source
+	dedupEntry struct {
+		msg   Message   // last distinct message
+		count int       // number of times it has been repeated since
+		last  Message   // most recent repeat
+		start time.Time // when the window started
+	}
+
+	// deduper collapses identical messages from a source within a window into
+	// a single message with a repeat count (like syslog's "last message repeated
+	// N times")
+	deduper struct {
+		window  time.Duration
+		mu      sync.Mutex
+		entries map[string]*dedupEntry
+		done    chan bool
+	}
+)
+
+// newDeduper creates a deduper. It returns nil if deduplication is disabled.
+func newDeduper() *deduper {
+	if config.DedupWindow < 1 {
+		return nil
+	}
+
+	return &deduper{
+		window:  time.Duration(config.DedupWindow) * time.Second,
+		entries: make(map[string]*dedupEntry),
+		done:    make(chan bool),
+	}
+}
+
+// dedup returns false if the message repeats the source's last message within
+// the window. If it doesn't, a pending repeat message for the source (if any)
+// is returned to be written first.
+func (d *deduper) dedup(msg Message) (bool, *Message) {
+	key := msg.Type + "\x00" + msg.Id
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e, ok := d.entries[key]
+	if ok && now.Sub(e.start) < d.window && identical(e.msg, msg) {
+		e.count++
+		e.last = msg
+		return false, nil
+	}
+
+	var repeated *Message
+	if ok {
+		repeated = e.repeated()
+	}
+	d.entries[key] = &dedupEntry{msg: msg, start: now}
+
+	return true, repeated
+}
+
+// expire returns the repeat messages of windows that have ended
+func (d *deduper) expire() []Message {
+	var repeats []Message
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, e := range d.entries {
+		if now.Sub(e.start) < d.window {
+			continue
+		}
+		if repeated := e.repeated(); repeated != nil {
+			repeats = append(repeats, *repeated)
+		}
+		delete(d.entries, key)
+	}
+
+	return repeats
+}
+
+// repeated returns the message summarizing the repeats, or nil if the message
+// wasn't repeated
+func (e *dedupEntry) repeated() *Message {
+	if e.count == 0 {
+		return nil
+	}
+
+	msg := e.msg
+	msg.Time = e.last.Time
+	msg.UTime = e.last.UTime
+	msg.Raw = nil
+	msg.Repeat = e.count
+
+	return &msg
+}
+
+// flush periodically broadcasts the repeat messages of ended windows
+func (d *deduper) flush(vac *Logvac) {
+	tick := time.NewTicker(d.window / 2)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			for _, msg := range d.expire() {
+				vac.broadcast(msg)
+			}
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// close stops flushing
+func (d *deduper) close() {
+	close(d.done)
+}
+
+// identical returns true if the messages have the same priority, tags, and content
+func identical(a, b Message) bool {
+	if a.Priority != b.Priority || a.Content != b.Content || len(a.Tag) != len(b.Tag) {
+		return false
+	}
+	for i := range a.Tag {
+		if a.Tag[i] != b.Tag[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,253 @@
+package logvac
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nanopack/logvac/config"
+)
+
+type (
+	// limitRule defines a token-bucket rate limit applied per id, token, or type
+	limitRule struct {
+		By     string  `json:"by"`     // what to limit by (id|token|type)
+		Rate   float64 `json:"rate"`   // messages allowed per second
+		Burst  float64 `json:"burst"`  // messages allowed in a burst (defaults to rate)
+		Action string  `json:"action"` // what to do with excess messages (drop|sample|downgrade)
+		Sample int     `json:"sample"` // keep 1 in `sample` excess messages (sample only)
+		Type   string  `json:"type"`   // type to store excess messages as (downgrade only)
+
+		mu      sync.Mutex
+		buckets map[string]*tokenBucket
+	}
+
+	// tokenBucket tracks the allowance and suppressed messages of a single source
+	tokenBucket struct {
+		tokens     float64
+		last       time.Time
+		excess     int // excess messages since the last summary
+		suppressed int // excess messages not kept since the last summary
+	}
+
+	// limiter rate limits messages at ingest and periodically reports what
+	// it suppressed
+	limiter struct {
+		rules    []*limitRule
+		interval time.Duration // how often to report (rate-limit-report)
+		done     chan bool
+	}
+)
+
+// newLimiter parses the configured rate limits. It returns nil if no limits
+// are configured.
+func newLimiter() (*limiter, error) {
+	if config.RateLimit == "" {
+		return nil, nil
+	}
+
+	var rules []*limitRule
+	err := json.Unmarshal([]byte(config.RateLimit), &rules)
+	if err != nil {
+		return nil, fmt.Errorf("Bad JSON syntax for rate-limit - %s", err)
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	for i, rule := range rules {
+		switch rule.By {
+		case "id", "token", "type":
+		default:
+			return nil, fmt.Errorf("Rate limit %d - can't limit by '%s' (id|token|type)", i, rule.By)
+		}
+		if rule.Rate <= 0 {
+			return nil, fmt.Errorf("Rate limit %d - rate must be greater than 0", i)
+		}
+		if rule.Burst < rule.Rate {
+			rule.Burst = rule.Rate
+		}
+		switch rule.Action {
+		case "", "drop":
+			rule.Action = "drop"
+		case "sample":
+			if rule.Sample < 1 {
+				return nil, fmt.Errorf("Rate limit %d - sample must be greater than 0", i)
+			}
+		case "downgrade":
+			if rule.Type == "" {
+				rule.Type = "throttled"
+			}
+		default:
+			return nil, fmt.Errorf("Rate limit %d - unknown action '%s' (drop|sample|downgrade)", i, rule.Action)
+		}
+		rule.buckets = make(map[string]*tokenBucket)
+	}
+
+	report := config.RateLimitReport
+	if report < 1 {
+		report = 60
+	}
+
+	return &limiter{rules: rules, interval: time.Duration(report) * time.Second, done: make(chan bool)}, nil
+}
+
+// limit applies the rate limits to a message, returning false if the message
+// should be dropped. Downgraded messages have their type changed.
+func (l *limiter) limit(msg *Message) bool {
+	now := time.Now()
+	for _, rule := range l.rules {
+		key := rule.key(*msg)
+		if rule.By == "token" && key == "" {
+			// messages without a token (syslog) aren't limited by token
+			continue
+		}
+		if rule.allow(key, now) {
+			continue
+		}
+
+		switch rule.Action {
+		case "drop":
+			return false
+		case "sample":
+			if !rule.sample(key) {
+				return false
+			}
+		case "downgrade":
+			msg.Type = rule.Type
+		}
+	}
+	return true
+}
+
+// key returns the source a message is limited by
+func (rule *limitRule) key(msg Message) string {
+	switch rule.By {
+	case "token":
+		return msg.Token
+	case "type":
+		return msg.Type
+	default:
+		return msg.Id
+	}
+}
+
+// allow takes a token from the source's bucket, returning false if the source
+// is over its limit
+func (rule *limitRule) allow(key string, now time.Time) bool {
+	rule.mu.Lock()
+	defer rule.mu.Unlock()
+
+	b, ok := rule.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rule.Burst, last: now}
+		rule.buckets[key] = b
+	}
+
+	// refill the bucket for the time passed
+	b.tokens += now.Sub(b.last).Seconds() * rule.Rate
+	if b.tokens > rule.Burst {
+		b.tokens = rule.Burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true
+	}
+
+	b.excess++
+	if rule.Action != "sample" {
+		b.suppressed++
+	}
+	return false
+}
+
+// sample returns true for 1 in `rule.Sample` excess messages
+func (rule *limitRule) sample(key string) bool {
+	rule.mu.Lock()
+	defer rule.mu.Unlock()
+
+	b := rule.buckets[key]
+	if (b.excess-1)%rule.Sample == 0 {
+		return true
+	}
+	b.suppressed++
+	return false
+}
+
+// summarize returns messages describing what was suppressed since the last
+// summary and forgets idle sources
+func (l *limiter) summarize(interval time.Duration) []Message {
+	var summaries []Message
+	now := time.Now()
+
+	for _, rule := range l.rules {
+		rule.mu.Lock()
+		keys := make([]string, 0, len(rule.buckets))
+		for key := range rule.buckets {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			b := rule.buckets[key]
+			if b.excess == 0 {
+				// a source idle long enough to have a full bucket can be forgotten
+				if now.Sub(b.last).Seconds()*rule.Rate+b.tokens >= rule.Burst {
+					delete(rule.buckets, key)
+				}
+				continue
+			}
+
+			var content string
+			switch rule.Action {
+			case "drop":
+				content = fmt.Sprintf("Rate limited %s '%s' - dropped %d messages in the last %s", rule.By, key, b.suppressed, interval)
+			case "sample":
+				content = fmt.Sprintf("Rate limited %s '%s' - kept 1 in %d, dropped %d of %d excess messages in the last %s", rule.By, key, rule.Sample, b.suppressed, b.excess, interval)
+			case "downgrade":
+				content = fmt.Sprintf("Rate limited %s '%s' - stored %d excess messages as type '%s' in the last %s", rule.By, key, b.excess, rule.Type, interval)
+			}
+
+			summaries = append(summaries, Message{
+				Time:     now,
+				UTime:    now.UnixNano(),
+				Id:       "logvac",
+				Tag:      []string{"logvac[limit]"},
+				Type:     config.LogType,
+				Priority: 3, // warn
+				Content:  content,
+			})
+			b.excess = 0
+			b.suppressed = 0
+		}
+		rule.mu.Unlock()
+	}
+
+	return summaries
+}
+
+// report periodically broadcasts a summary of suppressed messages
+func (l *limiter) report(vac *Logvac) {
+	tick := time.NewTicker(l.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			for _, summary := range l.summarize(l.interval) {
+				vac.broadcast(summary)
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// close stops reporting
+func (l *limiter) close() {
+	close(l.done)
+}
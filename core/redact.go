@@ -0,0 +1,183 @@
+package logvac
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/nanopack/logvac/config"
+)
+
+type (
+	// redactRule defines a pattern that gets scrubbed from logs before they are drained
+	redactRule struct {
+		name    string
+		pattern *regexp.Regexp
+		valid   func(string) bool // optional check to reduce false positives (luhn)
+		count   uint64            // number of redactions made by this rule
+	}
+
+	// redactor scrubs secrets and pii from messages
+	redactor struct {
+		rules []*redactRule
+		mask  string
+	}
+)
+
+// builtinRules are the detectors that can be enabled via `redact-builtin`
+var builtinRules = map[string][]string{
+	// 13-19 digits, optionally separated by spaces or dashes (luhn checked)
+	"credit-card": {`\b(?:\d[ -]?){12,18}\d\b`},
+	// "Authorization: Bearer <token>" style tokens (only the token gets masked)
+	"bearer-token": {`(?i)\bbearer\s+([a-z0-9\-._~+/]+=*)`},
+	// aws access key ids and secret access keys
+	"aws-key": {
+		`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,
+		`(?i)aws_?secret_?access_?key\W{0,5}([a-z0-9/+=]{40})\b`,
+	},
+}
+
+// newRedactor compiles the configured redaction rules. It returns nil if no
+// rules are configured.
+func newRedactor() (*redactor, error) {
+	r := &redactor{mask: config.RedactMask}
+
+	// built-in detectors
+	for _, name := range strings.Split(config.RedactBuiltin, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		patterns, ok := builtinRules[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown built-in redaction rule '%s'", name)
+		}
+		for i := range patterns {
+			rule := &redactRule{name: name, pattern: regexp.MustCompile(patterns[i])}
+			if name == "credit-card" {
+				rule.valid = luhn
+			}
+			r.rules = append(r.rules, rule)
+		}
+	}
+
+	// user defined rules
+	if config.Redact != "" {
+		var custom map[string]string
+		err := json.Unmarshal([]byte(config.Redact), &custom)
+		if err != nil {
+			return nil, fmt.Errorf("Bad JSON syntax for redact - %s", err)
+		}
+
+		// sort for consistent application
+		names := make([]string, 0, len(custom))
+		for name := range custom {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			pattern, err := regexp.Compile(custom[name])
+			if err != nil {
+				return nil, fmt.Errorf("Bad redaction rule '%s' - %s", name, err)
+			}
+			r.rules = append(r.rules, &redactRule{name: name, pattern: pattern})
+		}
+	}
+
+	if len(r.rules) == 0 {
+		return nil, nil
+	}
+
+	return r, nil
+}
+
+// redact scrubs the message's content and raw data
+func (r *redactor) redact(msg Message) Message {
+	for _, rule := range r.rules {
+		var found, rawFound int
+		msg.Content, found = rule.replace(msg.Content, r.mask)
+		if len(msg.Raw) != 0 {
+			var raw string
+			raw, rawFound = rule.replace(string(msg.Raw), r.mask)
+			msg.Raw = []byte(raw)
+		}
+		// raw data usually holds the content too, so a secret is counted once
+		if rawFound > found {
+			found = rawFound
+		}
+		atomic.AddUint64(&rule.count, uint64(found))
+	}
+	return msg
+}
+
+// replace masks all matches of the rule in s, returning the number masked. If
+// the pattern has a capture group, only the first group gets masked.
+func (rule *redactRule) replace(s, mask string) (string, int) {
+	matches := rule.pattern.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s, 0
+	}
+
+	out := &strings.Builder{}
+	last, found := 0, 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) > 2 && m[2] >= 0 {
+			start, end = m[2], m[3]
+		}
+		if rule.valid != nil && !rule.valid(s[start:end]) {
+			continue
+		}
+		out.WriteString(s[last:start])
+		out.WriteString(mask)
+		last = end
+		found++
+	}
+	out.WriteString(s[last:])
+
+	return out.String(), found
+}
+
+// stats returns the number of redactions made per rule
+func (r *redactor) stats() map[string]uint64 {
+	counts := make(map[string]uint64, len(r.rules))
+	for _, rule := range r.rules {
+		counts[rule.name] += atomic.LoadUint64(&rule.count)
+	}
+	return counts
+}
+
+// luhn validates a credit card number (ignoring spaces and dashes)
+func luhn(number string) bool {
+	sum, digits := 0, 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+		double = !double
+	}
+	return digits >= 13 && sum%10 == 0
+}
+
+// RedactStats returns the number of redactions made per rule
+func RedactStats() map[string]uint64 {
+	if Vac.redactor == nil {
+		return map[string]uint64{}
+	}
+	return Vac.redactor.stats()
+}
@@ -0,0 +1,124 @@
+package drain
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// names of the db files in a snapshot (see Snapshot)
+const (
+	snapArchive    = "archive.bolt"        // the main db
+	snapPartitions = "archive.partitions/" // partitions, by type
+	snapDrains     = "drains.bolt"         // drain config
+)
+
+// Snapshot calls fn with a read transaction on each db file of the archive
+// (the main db first, then every partition), named as in a backup. Expiring
+// and compacting wait until it's done; logs are still written.
+func (a *BoltArchive) Snapshot(fn func(name string, tx *bolt.Tx) error) error {
+	a.maint.Lock()
+	defer a.maint.Unlock()
+
+	err := a.db.View(func(tx *bolt.Tx) error {
+		return fn(snapArchive, tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	var parts []*partition
+	a.pTex.RLock()
+	for _, kind := range a.parts {
+		parts = append(parts, kind...)
+	}
+	a.pTex.RUnlock()
+
+	for _, p := range parts {
+		rel, err := filepath.Rel(a.partDir(), p.path)
+		if err != nil {
+			return err
+		}
+		err = p.db.View(func(tx *bolt.Tx) error {
+			return fn(snapPartitions+filepath.ToSlash(rel), tx)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapshotDrains calls fn with a read transaction on the drain config db, if
+// any drains were ever configured
+func snapshotDrains(fn func(name string, tx *bolt.Tx) error) error {
+	path := filepath.Join(dbDir, "drains.bolt")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	db, err := bolt.Open(path, 0644, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		return fn(snapDrains, tx)
+	})
+}
+
+// SnapshotPath returns where a db file of a backup (see Snapshot) is restored
+// to under the configured 'db-address', or "" if it isn't the archive's.
+func SnapshotPath(name string) (string, error) {
+	u, err := dbURL()
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case name == snapArchive:
+		return u.Path, nil
+	case name == snapDrains:
+		return filepath.Join(filepath.Dir(u.Path), "drains.bolt"), nil
+	case strings.HasPrefix(name, snapPartitions):
+		rel := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(name, snapPartitions)))
+		if filepath.IsAbs(rel) || rel == "." || strings.HasPrefix(rel, "..") {
+			return "", fmt.Errorf("Bad partition '%s' in backup", name)
+		}
+		return filepath.Join(partDir(u.Path), rel), nil
+	}
+
+	return "", nil
+}
+
+// RemoveArchive removes the archive's db files (the main db and partitions)
+// at the configured 'db-address', so a backup can replace them. Other files,
+// such as those of the backup waiting to replace them, are left.
+func RemoveArchive() error {
+	u, err := dbURL()
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(u.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = filepath.Walk(partDir(u.Path), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && filepath.Ext(path) == ".bolt" {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,453 @@
+package drain
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/nanopack/logvac/config"
+	"github.com/nanopack/logvac/core"
+)
+
+const (
+	coldBucket = "_cold"          // bucket (in the main db) holding how far each type is offloaded
+	hourBucket = "_hours"         // bucket (in each db) holding the hours of each type written to since offloading them
+	coldHour   = int64(time.Hour) // logs are offloaded an hour per object
+	coldFormat = "2006/01/02/15"  // hour of an object's logs, in its key
+	coldSuffix = ".ndjson.gz"     // gzipped newline delimited json
+)
+
+// offload uploads the logs of a type from each hour since the last offload (up
+// to the current hour) to cold storage, an object per hour, returning the time
+// before which the type's logs are in cold storage. Hours offloaded before that
+// have since been written to (by restores, or logs that arrive late) are
+// offloaded again, merged with their objects.
+func (a *BoltArchive) offload(kind string, now int64) (int64, error) {
+	mark := a.coldMark(kind)
+	until := now - now%coldHour
+
+	late, err := a.takeHours(kind, until)
+	if err != nil {
+		return mark, fmt.Errorf("Failed to offload '%s' logs - %s", kind, err)
+	}
+
+	// hours after the mark are offloaded from it
+	for len(late) != 0 && late[len(late)-1] >= mark {
+		late = late[:len(late)-1]
+	}
+
+	safe := mark
+	if mark < until {
+		safe, err = a.offloadSince(kind, mark, until)
+	}
+	for i := 0; err == nil && i < len(late); i++ {
+		if err = a.reoffload(kind, late[i]); err != nil {
+			err = fmt.Errorf("Failed to offload '%s' logs again - %s", kind, err)
+			break
+		}
+		config.Log.Debug("Offloaded '%s' logs of %s again", kind, time.Unix(0, late[i]).UTC())
+		late[i] = -1
+	}
+	if err != nil {
+		// try the rest again next time, keeping their logs until then
+		for _, hour := range late {
+			if hour != -1 {
+				a.putHour(kind, hour)
+				safe = earliest(safe, hour)
+			}
+		}
+		return safe, err
+	}
+
+	return safe, nil
+}
+
+// offloadSince uploads the logs of a type from mark until the hour starting at
+// until, returning how far they're offloaded
+func (a *BoltArchive) offloadSince(kind string, mark, until int64) (int64, error) {
+	hour := int64(-1)
+	buf := &bytes.Buffer{}
+	var gz *gzip.Writer
+	var encoder *json.Encoder
+	flush := func() error {
+		if gz == nil {
+			return nil
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		if err := a.cold.put(coldKey(kind, hour), buf.Bytes()); err != nil {
+			return err
+		}
+		gz = nil
+		buf.Reset()
+		return a.setColdMark(kind, hour+coldHour)
+	}
+
+	query := Query{Type: kind, End: mark, Start: until - 1, Limit: math.MaxInt64, Forward: true}
+	err := a.Walk(query, func(msg logvac.Message) error {
+		if h := msg.UTime - msg.UTime%coldHour; h != hour {
+			if err := flush(); err != nil {
+				return err
+			}
+			hour = h
+			gz = gzip.NewWriter(buf)
+			encoder = json.NewEncoder(gz)
+		}
+		return encoder.Encode(msg)
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return a.coldMark(kind), fmt.Errorf("Failed to offload '%s' logs - %s", kind, err)
+	}
+
+	config.Log.Debug("Offloaded '%s' logs up to %s", kind, time.Unix(0, until).UTC())
+	return until, a.setColdMark(kind, until)
+}
+
+// reoffload uploads the logs of a type from an hour already offloaded, merged
+// with those offloaded before (a log's utime is its key, as in the archive)
+func (a *BoltArchive) reoffload(kind string, hour int64) error {
+	key := coldKey(kind, hour)
+	logs := make(map[int64]logvac.Message)
+
+	found, err := a.cold.list(key)
+	if err != nil {
+		return err
+	}
+	if len(found) != 0 {
+		offloaded, err := a.readCold(key)
+		if err != nil {
+			return err
+		}
+		for i := range offloaded {
+			logs[offloaded[i].UTime] = offloaded[i]
+		}
+	}
+
+	query := Query{Type: kind, End: hour, Start: hour + coldHour - 1, Limit: math.MaxInt64, Forward: true}
+	err = a.Walk(query, func(msg logvac.Message) error {
+		logs[msg.UTime] = msg
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	merged := make([]logvac.Message, 0, len(logs))
+	for _, msg := range logs {
+		merged = append(merged, msg)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].UTime < merged[j].UTime })
+	return a.putCold(key, merged)
+}
+
+// recordHour records that a log was written to its hour, so the hour is
+// offloaded to cold storage (again, if it already was) within a transaction
+func recordHour(tx *bolt.Tx, msg logvac.Message) error {
+	if config.ColdAddress == "" {
+		return nil
+	}
+	hours, err := tx.CreateBucketIfNotExists([]byte(hourBucket))
+	if err != nil {
+		return err
+	}
+	bucket, err := hours.CreateBucketIfNotExists([]byte(msg.Type))
+	if err != nil {
+		return err
+	}
+	key := utimeKey(msg.UTime - msg.UTime%coldHour)
+	if bucket.Get(key) != nil {
+		return nil
+	}
+	return bucket.Put(key, []byte("true"))
+}
+
+// takeHours returns the hours of a type written to before until (oldest
+// first), forgetting them so writes from now on are recorded anew (maint must be
+// held, see Compact)
+func (a *BoltArchive) takeHours(kind string, until int64) ([]int64, error) {
+	taken := make(map[int64]bool)
+	for _, p := range a.partitions(kind, 0, 0) {
+		var found []int64
+		p.db.View(func(tx *bolt.Tx) error {
+			if hours := tx.Bucket([]byte(hourBucket)); hours != nil {
+				if bucket := hours.Bucket([]byte(kind)); bucket != nil {
+					c := bucket.Cursor()
+					for k, _ := c.First(); k != nil && utime(k) < until; k, _ = c.Next() {
+						found = append(found, utime(k))
+					}
+				}
+			}
+			return nil
+		})
+		if len(found) == 0 {
+			continue
+		}
+
+		err := p.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(hourBucket)).Bucket([]byte(kind))
+			for _, hour := range found {
+				if err := bucket.Delete(utimeKey(hour)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, hour := range found {
+			taken[hour] = true
+		}
+	}
+
+	hours := make([]int64, 0, len(taken))
+	for hour := range taken {
+		hours = append(hours, hour)
+	}
+	sort.Slice(hours, func(i, j int) bool { return hours[i] < hours[j] })
+	return hours, nil
+}
+
+// putHour records an hour of a type as written to again, in the main db, after
+// failing to offload it (maint must be held, see Compact)
+func (a *BoltArchive) putHour(kind string, hour int64) {
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		return recordHour(tx, logvac.Message{Type: kind, UTime: hour})
+	})
+	if err != nil {
+		config.Log.Error("Failed to record '%s' hour to offload - %s", kind, err)
+	}
+}
+
+// coldKey returns the key of the object holding a type's logs of an hour
+func coldKey(kind string, hour int64) string {
+	return escapeType(kind) + "/" + time.Unix(0, hour).UTC().Format(coldFormat) + coldSuffix
+}
+
+// coldMark returns the time before which a type's logs are in cold storage
+func (a *BoltArchive) coldMark(kind string) int64 {
+	var mark int64
+	a.wTex.RLock()
+	defer a.wTex.RUnlock()
+	a.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(coldBucket)); bucket != nil {
+			if v := bucket.Get([]byte(kind)); len(v) == 8 {
+				mark = utime(v)
+			}
+		}
+		return nil
+	})
+	return mark
+}
+
+// setColdMark records the time before which a type's logs are in cold storage
+// (maint must be held, see Compact)
+func (a *BoltArchive) setColdMark(kind string, mark int64) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(coldBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(kind), utimeKey(mark))
+	})
+}
+
+// SliceCold returns the logs of a type in cold storage matching the query
+// (oldest first), reading an hour of logs at a time until the limit is met
+func (a *BoltArchive) SliceCold(query Query) ([]logvac.Message, error) {
+	if a.cold == nil {
+		return nil, fmt.Errorf("Cold storage isn't configured")
+	}
+	if query.Type == "" || strings.ContainsAny(query.Type, ",*") {
+		return nil, fmt.Errorf("Cold logs are read a type at a time")
+	}
+
+	// in the order read
+	hours, err := a.coldKeys(query.Type, query.Start, query.End)
+	if err != nil {
+		return nil, err
+	}
+	if !query.Forward {
+		for i, j := 0, len(hours)-1; i < j; i, j = i+1, j-1 {
+			hours[i], hours[j] = hours[j], hours[i]
+		}
+	}
+
+	messages := make([]logvac.Message, 0)
+	for _, key := range hours {
+		if int64(len(messages)) >= query.Limit {
+			break
+		}
+		logs, err := a.readCold(key)
+		if err != nil {
+			return nil, err
+		}
+
+		sort.SliceStable(logs, func(i, j int) bool {
+			if query.Forward {
+				return logs[i].UTime < logs[j].UTime
+			}
+			return logs[i].UTime > logs[j].UTime
+		})
+		for i := range logs {
+			if (query.End != 0 && logs[i].UTime < query.End) || (query.Start != 0 && logs[i].UTime > query.Start) {
+				continue
+			}
+			if !query.Match(logs[i]) {
+				continue
+			}
+			messages = append(messages, logs[i])
+			if int64(len(messages)) >= query.Limit {
+				break
+			}
+		}
+	}
+
+	// display newest last
+	for i, j := 0, len(messages)-1; i < j && !query.Forward; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	return messages, nil
+}
+
+// coldKeys returns the keys of the objects holding a type's logs of the hours
+// between start and end (0 leaves that end open), oldest first
+func (a *BoltArchive) coldKeys(kind string, start, end int64) ([]string, error) {
+	prefix := escapeType(kind) + "/"
+	keys, err := a.cold.list(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list cold logs - %s", err)
+	}
+
+	hours := make([]string, 0, len(keys))
+	for _, key := range keys {
+		t, err := time.Parse(coldFormat, strings.TrimSuffix(strings.TrimPrefix(key, prefix), coldSuffix))
+		if err != nil {
+			continue
+		}
+		hour := t.UnixNano()
+		if (end != 0 && hour+coldHour <= end) || (start != 0 && hour > start) {
+			continue
+		}
+		hours = append(hours, key)
+	}
+	return hours, nil
+}
+
+// coldTypes returns the types of logs offloaded to cold storage
+func (a *BoltArchive) coldTypes() []string {
+	var kinds []string
+	a.wTex.RLock()
+	defer a.wTex.RUnlock()
+	a.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(coldBucket)); bucket != nil {
+			return bucket.ForEach(func(k, v []byte) error {
+				kinds = append(kinds, string(k))
+				return nil
+			})
+		}
+		return nil
+	})
+	return kinds
+}
+
+// purgeCold removes the logs of a type in cold storage matching the query
+// (unless held), rewriting each object holding any (or deleting it if nothing
+// is left), and returns the number of logs removed. A dry run only counts them.
+func (a *BoltArchive) purgeCold(query Query, held holds, dryRun bool) (int64, error) {
+	hours, err := a.coldKeys(query.Type, query.Start, query.End)
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	for _, key := range hours {
+		logs, err := a.readCold(key)
+		if err != nil {
+			return deleted, err
+		}
+
+		kept := logs[:0]
+		for i := range logs {
+			if (query.End == 0 || logs[i].UTime >= query.End) && (query.Start == 0 || logs[i].UTime <= query.Start) &&
+				query.Match(logs[i]) && !held.keepsLog(logs[i]) {
+				deleted++
+				continue
+			}
+			kept = append(kept, logs[i])
+		}
+		if dryRun || len(kept) == len(logs) {
+			continue
+		}
+
+		if len(kept) == 0 {
+			err = a.cold.delete(key)
+		} else {
+			err = a.putCold(key, kept)
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("Failed to rewrite cold logs '%s' - %s", key, err)
+		}
+	}
+
+	return deleted, nil
+}
+
+// putCold encodes logs and stores them in cold storage
+func (a *BoltArchive) putCold(key string, logs []logvac.Message) error {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	encoder := json.NewEncoder(gz)
+	for i := range logs {
+		if err := encoder.Encode(logs[i]); err != nil {
+			return err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return a.cold.put(key, buf.Bytes())
+}
+
+// readCold fetches and decodes the logs of an object in cold storage
+func (a *BoltArchive) readCold(key string) ([]logvac.Message, error) {
+	body, err := a.cold.get(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch cold logs - %s", err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read cold logs '%s' - %s", key, err)
+	}
+	defer gz.Close()
+
+	var logs []logvac.Message
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), dumpLineMax)
+	for scanner.Scan() {
+		msg, err := decode(scanner.Bytes())
+		if err != nil {
+			config.Log.Debug("Failed to decode cold log - %s", err)
+			continue
+		}
+		logs = append(logs, msg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read cold logs '%s' - %s", key, err)
+	}
+
+	return logs, nil
+}
@@ -0,0 +1,290 @@
+package drain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/nanopack/logvac/config"
+	"github.com/nanopack/logvac/core"
+)
+
+const compactCatchUp = 1000 // logs written while copying that are left to write with writes stopped
+
+// compactTxSize is the number of bytes copied per transaction while compacting
+var compactTxSize = 64 << 20
+
+type (
+	// CompactStats describes the space reclaimed by compacting the archive
+	CompactStats struct {
+		Files  int   `json:"files"`  // number of db files compacted
+		Before int64 `json:"before"` // size (bytes) of the files before compacting
+		After  int64 `json:"after"`  // size (bytes) of the files after compacting
+	}
+)
+
+// Compact reclaims the space freed by expired logs. Bolt never shrinks its
+// file, so each db file (the main db and every partition) is copied to a fresh
+// file (a chunk per transaction) which then replaces it. Logs are written to the
+// old file while copying and written again to the new one before it's swapped
+// in; anything else written to the main db (holds, purge records, cold marks)
+// holds maint, so waits until compacting is done.
+func (a *BoltArchive) Compact() (*CompactStats, error) {
+	a.maint.Lock()
+	defer a.maint.Unlock()
+
+	stats := &CompactStats{}
+
+	// the main db first, then each partition
+	parts := []*partition{{path: a.path}}
+	a.pTex.RLock()
+	for _, kind := range a.parts {
+		parts = append(parts, kind...)
+	}
+	a.pTex.RUnlock()
+
+	for _, p := range parts {
+		before, after, err := a.compact(p)
+		if err != nil {
+			return stats, fmt.Errorf("Failed to compact '%s' - %s", p.path, err)
+		}
+		stats.Files++
+		stats.Before += before
+		stats.After += after
+	}
+
+	config.Log.Info("Compacted %d archive files from %d to %d bytes", stats.Files, stats.Before, stats.After)
+	return stats, nil
+}
+
+// compact copies a db file (the main db if p.db is nil) to a fresh file and
+// swaps it in, returning the sizes before and after
+func (a *BoltArchive) compact(p *partition) (int64, int64, error) {
+	a.wTex.RLock()
+	old := p.db
+	if old == nil {
+		old = a.db
+	}
+	a.wTex.RUnlock()
+
+	// remember logs written from here on
+	a.cTex.Lock()
+	if a.pending == nil {
+		a.pending = make(map[*bolt.DB][]logvac.Message)
+	}
+	a.pending[old] = []logvac.Message{}
+	a.cTex.Unlock()
+	defer func() {
+		a.cTex.Lock()
+		delete(a.pending, old)
+		a.cTex.Unlock()
+	}()
+
+	tmp := p.path + ".compact"
+	os.Remove(tmp)
+	fresh, err := bolt.Open(tmp, 0644, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var before int64
+	old.View(func(tx *bolt.Tx) error {
+		before = tx.Size()
+		return nil
+	})
+	if err = copyDB(old, fresh); err != nil {
+		fresh.Close()
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+
+	// catch up on the logs written while copying, so few are left to write
+	// with writes stopped
+	for {
+		a.cTex.Lock()
+		pending := a.pending[old]
+		a.pending[old] = []logvac.Message{}
+		a.cTex.Unlock()
+		if err = replay(fresh, pending); err != nil {
+			fresh.Close()
+			os.Remove(tmp)
+			return 0, 0, err
+		}
+		if len(pending) < compactCatchUp {
+			break
+		}
+	}
+
+	// stop writes to swap the files
+	a.wTex.Lock()
+	defer a.wTex.Unlock()
+
+	a.cTex.Lock()
+	pending := a.pending[old]
+	a.cTex.Unlock()
+	if err = replay(fresh, pending); err != nil {
+		fresh.Close()
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+
+	if err = os.Rename(tmp, p.path); err != nil {
+		fresh.Close()
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+	if p.db == nil {
+		a.db = fresh
+	} else {
+		p.db = fresh
+	}
+	if err = old.Close(); err != nil {
+		config.Log.Error("Failed to close compacted db - %s", err)
+	}
+
+	var after int64
+	fresh.View(func(tx *bolt.Tx) error {
+		after = tx.Size()
+		return nil
+	})
+
+	return before, after, nil
+}
+
+// copyDB copies every bucket of src to dst, committing every compactTxSize
+// bytes. Each chunk is read in its own transaction, so a long read doesn't keep
+// writes to src from growing it.
+func copyDB(src, dst *bolt.DB) error {
+	var from [][]byte // path to the last key copied
+	for {
+		done := true
+		err := src.View(func(tx *bolt.Tx) error {
+			dtx, err := dst.Begin(true)
+			if err != nil {
+				return err
+			}
+			defer dtx.Rollback()
+
+			var size int
+			put := func(path [][]byte, k, v []byte) error {
+				// find (or create) the bucket in the new db
+				bucket, err := dtx.CreateBucketIfNotExists(path[0])
+				if err != nil {
+					return err
+				}
+				for _, name := range path[1:] {
+					if bucket, err = bucket.CreateBucketIfNotExists(name); err != nil {
+						return err
+					}
+				}
+				if k == nil {
+					return nil
+				}
+
+				// logs are keyed by time, so they're always appended
+				bucket.FillPercent = 1.0
+				if err = bucket.Put(k, v); err != nil {
+					return err
+				}
+
+				// stop once the chunk is full, remembering where
+				size += len(k) + len(v)
+				if size > compactTxSize {
+					from = append(copyPath(path), append([]byte{}, k...))
+					done = false
+					return errChunk
+				}
+				return nil
+			}
+
+			err = copyBucket(tx.Cursor(), tx.Bucket, nil, from, put)
+			if err != nil && err != errChunk {
+				return err
+			}
+			return dtx.Commit()
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// errChunk stops copying once a chunk is full
+var errChunk = errors.New("chunk full")
+
+// copyBucket calls put for every key under the cursor (in nested buckets too)
+// after the path from, with the path of the bucket holding it (and once with a
+// nil key for each bucket, so empty buckets are kept). nested returns the
+// bucket of a key holding one.
+func copyBucket(c *bolt.Cursor, nested func([]byte) *bolt.Bucket, path, from [][]byte, put func(path [][]byte, k, v []byte) error) error {
+	var k, v []byte
+	if len(from) != 0 {
+		k, v = c.Seek(from[0])
+	} else {
+		k, v = c.First()
+	}
+	for ; k != nil; k, v = c.Next() {
+		// only the first key may be where the last chunk stopped
+		resume := len(from) != 0 && bytes.Equal(k, from[0])
+		rest := from
+		from = nil
+
+		if v == nil {
+			// a nested bucket
+			inner := append(copyPath(path), k)
+			if err := put(inner, nil, nil); err != nil {
+				return err
+			}
+			b := nested(k)
+			var after [][]byte
+			if resume {
+				after = rest[1:]
+			}
+			if err := copyBucket(b.Cursor(), b.Bucket, inner, after, put); err != nil {
+				return err
+			}
+			continue
+		}
+		if resume && len(rest) == 1 {
+			// copied by the last chunk
+			continue
+		}
+		if err := put(path, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyPath returns a copy of a bucket path
+func copyPath(path [][]byte) [][]byte {
+	return append([][]byte{}, path...)
+}
+
+// replay writes logs tracked while compacting to the compacted db
+func replay(db *bolt.DB, msgs []logvac.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		for i := range msgs {
+			if err := store(tx, msgs[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// track remembers a log written to a db being compacted
+func (a *BoltArchive) track(db *bolt.DB, msg logvac.Message) {
+	a.cTex.Lock()
+	defer a.cTex.Unlock()
+
+	if pending, ok := a.pending[db]; ok {
+		a.pending[db] = append(pending, msg)
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strconv"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -17,11 +19,36 @@ import (
 	"github.com/nanopack/logvac/core"
 )
 
+// walkBatch is the number of logs read at a time when walking logs
+const walkBatch = 1000
+
+// openTimeout is how long to wait for a db held by another process (a running
+// logvac) before giving up
+var openTimeout = 5 * time.Second
+
 type (
 	// BoltArchive is a boltDB archiver
 	BoltArchive struct {
 		db   *bolt.DB
 		Done chan bool
+
+		path   string                  // location of the main db file
+		period int64                   // nanoseconds of logs each partition holds (0 archives to the main db)
+		pTex   *sync.RWMutex           // guards parts
+		parts  map[string][]*partition // partitions of each type (oldest first)
+
+		wTex    *sync.RWMutex                 // held to write or read, and to swap dbs when compacting
+		maint   *sync.Mutex                   // held while compacting, expiring, or indexing, and to write anything but logs to the main db
+		cTex    *sync.Mutex                   // guards pending
+		pending map[*bolt.DB][]logvac.Message // logs written to each db being compacted
+
+		nTex    *sync.Mutex          // guards written
+		written map[string]chan bool // closed when a log of the type is written (wakes followers)
+
+		keep    map[string]*keepPolicy // how long, how many, or how much of each type to keep (log-keep)
+		cold    *s3Client              // where logs are offloaded before expiring (cold-address)
+		sTex    *sync.Mutex            // guards expired
+		expired ExpireStats            // logs removed by expiring
 	}
 )
 
@@ -31,14 +58,28 @@ func NewBoltArchive(path string) (*BoltArchive, error) {
 	if err != nil {
 		return nil, err
 	}
-	d, err := bolt.Open(path, 0644, nil)
+	d, err := bolt.Open(path, 0644, &bolt.Options{Timeout: openTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("Failed to open '%s' - in use by another process (is logvac running?)", path)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	archive := BoltArchive{
-		db:   d,
-		Done: make(chan bool),
+		db:    d,
+		Done:  make(chan bool),
+		path:  path,
+		pTex:  &sync.RWMutex{},
+		parts: make(map[string][]*partition),
+		wTex:  &sync.RWMutex{},
+		maint: &sync.Mutex{},
+		cTex:  &sync.Mutex{},
+
+		nTex:    &sync.Mutex{},
+		written: make(map[string]chan bool),
+
+		sTex: &sync.Mutex{},
 	}
 
 	return &archive, nil
@@ -46,27 +87,342 @@ func NewBoltArchive(path string) (*BoltArchive, error) {
 
 // Init initializes the archiver drain
 func (a *BoltArchive) Init() error {
+	err := a.open()
+	if err != nil {
+		return err
+	}
+
+	// index logs archived before indexing existed
+	go a.buildIndexes()
+
 	// add drain
 	logvac.AddDrain("historical", a.Write)
 
 	return nil
 }
 
+// open readies the archive to be read and written, without archiving logs from
+// logvac or indexing old logs (for commands working on a stopped logvac's archive)
+func (a *BoltArchive) open() error {
+	// validate log-keep now, rather than once expiring
+	keep, err := parseLogKeep(config.LogKeep)
+	if err != nil {
+		return err
+	}
+	a.keep = keep
+
+	// offload logs to cold storage before expiring them
+	if config.ColdAddress != "" {
+		a.cold, err = newS3Client(config.ColdAddress)
+		if err != nil {
+			return err
+		}
+	}
+
+	// open the partitions of previous runs
+	err = a.openPartitions()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // Close closes the bolt db
 func (a *BoltArchive) Close() {
+	a.closePartitions()
+
 	err := a.db.Close()
 	if err != nil {
 		config.Log.Error("Faile to close bolt - %s", err.Error())
 	}
 }
 
-// Slice returns a slice of logs based on the name, offset, limit, and log-level
-func (a *BoltArchive) Slice(name, host string, tag []string, offset, end, limit int64, level int) ([]logvac.Message, error) {
-	var messages []logvac.Message
+// Slice returns a slice of logs matching the query (oldest first)
+func (a *BoltArchive) Slice(query Query) ([]logvac.Message, error) {
+	var scanned int64
+	messages, err := a.read(query, &scanned)
+	if err != nil {
+		return nil, err
+	}
+
+	// display newest last
+	for i, j := 0, len(messages)-1; i < j && !query.Forward; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
 
-	err := a.db.View(func(tx *bolt.Tx) error {
-		messages = make([]logvac.Message, 0)
-		bucket := tx.Bucket([]byte(name))
+	// config.Log.Trace("Messages: %+q", messages)
+	return messages, nil
+}
+
+// Walk calls fn with each log matching the query in the order read (newest
+// first, or oldest first if reading forward), stopping if fn returns an error.
+// Logs are read in batches so the archive isn't held while fn runs.
+func (a *BoltArchive) Walk(query Query, fn func(msg logvac.Message) error) error {
+	var scanned int64
+	remaining := query.Limit
+
+	// several types may log at the same time, so each batch continues from the
+	// last log's time, skipping the types already read at it (a type logs once
+	// per utime)
+	var last int64
+	seen := map[string]bool{}
+	for remaining > 0 {
+		batch := query
+		batch.Limit = walkBatch
+		if remaining < walkBatch {
+			batch.Limit = remaining
+		}
+		batch.Limit += int64(len(seen))
+
+		messages, err := a.read(batch, &scanned)
+		if err != nil {
+			return err
+		}
+		for i := range messages {
+			if remaining == 0 {
+				return nil
+			}
+			if messages[i].UTime == last && seen[messages[i].Type] {
+				continue
+			}
+			if err = fn(messages[i]); err != nil {
+				return err
+			}
+			remaining--
+
+			if messages[i].UTime != last {
+				last = messages[i].UTime
+				seen = map[string]bool{}
+			}
+			seen[messages[i].Type] = true
+		}
+
+		// a short batch means there is nothing left to read (or scan)
+		if int64(len(messages)) < batch.Limit {
+			return nil
+		}
+
+		// continue from the last log read
+		if query.Forward {
+			query.End = last
+		} else {
+			query.Start = last
+		}
+	}
+
+	return nil
+}
+
+// Histogram counts the logs matching the query (between its end and start) per
+// interval (nanoseconds) of time, and per level, id, or tag if grouped. Logs
+// are only decoded as far as the query and group need.
+func (a *BoltArchive) Histogram(query Query, interval int64, group string) ([]HistogramBucket, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("Bad interval - must be greater than 0")
+	}
+	if !ValidGroup(group) {
+		return nil, fmt.Errorf("Bad group '%s' (level|id|tag)", group)
+	}
+
+	a.wTex.RLock()
+	defer a.wTex.RUnlock()
+
+	// content filters need whole logs, plain counts only need their keys
+	whole := query.Content != "" || query.Regexp != nil || query.Predicate != nil
+	bare := !whole && group == "" && query.Level == 0 && len(query.Levels) == 0 && len(query.Id) == 0 && len(query.Tag) == 0
+
+	h := newHistogram(interval, group)
+	for _, kind := range a.types(query.Type) {
+		typed := query
+		typed.Type = kind
+		for _, p := range a.partitions(kind, query.Start, query.End) {
+			err := scan(p.db, typed, func(k, v []byte) (bool, error) {
+				if bare {
+					h.add(int64(binary.BigEndian.Uint64(k)), logvac.Message{})
+					return true, nil
+				}
+				msg, err := decodeHeader(v, whole)
+				if err != nil {
+					return false, err
+				}
+				if query.Match(msg) {
+					h.add(msg.UTime, msg)
+				}
+				return true, nil
+			})
+			if err == bolt.ErrDatabaseNotOpen {
+				// partition expired while reading
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return h.result(query.End, query.Start)
+}
+
+// read returns the logs matching the query in the order read, counting the
+// logs examined in scanned. Logs of several types are merged by time.
+func (a *BoltArchive) read(query Query, scanned *int64) ([]logvac.Message, error) {
+	a.wTex.RLock()
+	defer a.wTex.RUnlock()
+
+	kinds := a.types(query.Type)
+	if len(kinds) == 1 {
+		query.Type = kinds[0]
+		return a.readType(query, scanned)
+	}
+
+	// the first `limit` logs of the merged types are among the first `limit` of each
+	merged := make([]logvac.Message, 0)
+	for _, kind := range kinds {
+		typed := query
+		typed.Type = kind
+		messages, err := a.readType(typed, scanned)
+		if err != nil {
+			return nil, err
+		}
+		merged = append(merged, messages...)
+	}
+
+	return merge(merged, query.Forward, query.Limit), nil
+}
+
+// merge orders logs read from several places by time (in the order read),
+// keeping the first `limit`
+func merge(messages []logvac.Message, forward bool, limit int64) []logvac.Message {
+	sort.SliceStable(messages, func(i, j int) bool {
+		if forward {
+			return messages[i].UTime < messages[j].UTime
+		}
+		return messages[i].UTime > messages[j].UTime
+	})
+	if int64(len(messages)) > limit {
+		messages = messages[:limit]
+	}
+	return messages
+}
+
+// types returns the types a query reads: a type, a list of types ("app,deploy"),
+// or every archived type ("*")
+func (a *BoltArchive) types(kind string) []string {
+	if kind != "*" {
+		return strings.Split(kind, ",")
+	}
+
+	found := map[string]bool{}
+	a.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if !reserved(string(name)) {
+				found[string(name)] = true
+			}
+			return nil
+		})
+	})
+	a.pTex.RLock()
+	for kind := range a.parts {
+		found[kind] = true
+	}
+	a.pTex.RUnlock()
+
+	kinds := make([]string, 0, len(found))
+	for kind := range found {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// reserved returns whether a bucket holds the archive's own records rather
+// than logs
+func reserved(name string) bool {
+	return name == indexBucket || name == coldBucket || name == hourBucket || name == auditBucket || name == holdBucket
+}
+
+// readType returns the logs of a single type matching the query in the order
+// read (wTex must be held)
+func (a *BoltArchive) readType(query Query, scanned *int64) ([]logvac.Message, error) {
+	messages := make([]logvac.Message, 0)
+	var err error
+
+	// read partitions newest to oldest (or oldest to newest) until enough logs are found
+	parts := a.partitions(query.Type, query.Start, query.End)
+	if query.Forward {
+		sort.SliceStable(parts, func(i, j int) bool { return parts[i].start < parts[j].start })
+	}
+	for _, p := range parts {
+		if query.ScanLimit > 0 && *scanned >= query.ScanLimit {
+			break
+		}
+		// a partition past the logs found so far only continues them
+		n := len(messages)
+		past := n == 0 || (!query.Forward && p.end <= messages[n-1].UTime) || (query.Forward && p.start > messages[n-1].UTime)
+		if past && int64(n) >= query.Limit {
+			break
+		}
+
+		if past {
+			messages, err = slice(p.db, query, messages, scanned)
+		} else {
+			// one overlapping the logs found (the main db) is merged with them
+			var found []logvac.Message
+			found, err = slice(p.db, query, make([]logvac.Message, 0), scanned)
+			messages = merge(append(messages, found...), query.Forward, query.Limit)
+		}
+		if err == bolt.ErrDatabaseNotOpen {
+			// partition expired while reading
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return messages, nil
+}
+
+// slice appends the logs in db matching the query to messages (newest first,
+// or oldest first if reading forward)
+func slice(db *bolt.DB, query Query, messages []logvac.Message, scanned *int64) ([]logvac.Message, error) {
+	limit := query.Limit - int64(len(messages))
+	if limit <= 0 {
+		return messages, nil
+	}
+
+	err := scan(db, query, func(k, v []byte) (bool, error) {
+		// bound the cost of sparse matches
+		if query.ScanLimit > 0 && *scanned >= query.ScanLimit {
+			config.Log.Debug("Scan limit reached after %d logs", *scanned)
+			return false, nil
+		}
+		*scanned++
+
+		// unmarshal to check if match.. seems expensive
+		msg, err := decode(v)
+		if err != nil {
+			return false, err
+		}
+
+		if query.Match(msg) {
+			limit--
+			messages = append(messages, msg)
+		}
+		return limit > 0, nil
+	})
+
+	return messages, err
+}
+
+// scan calls fn with the key and value of each log in db between the query's
+// start and end (newest first, or oldest first if reading forward), until fn
+// returns false. Only logs of the query's type are scanned, using an index if
+// the query allows.
+func scan(db *bolt.DB, query Query, fn func(k, v []byte) (bool, error)) error {
+	return db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(query.Type))
 
 		if bucket == nil {
 			return nil
@@ -79,93 +435,89 @@ func (a *BoltArchive) Slice(name, host string, tag []string, offset, end, limit
 
 		// prepare to skip to the correct id
 		initial := &bytes.Buffer{}
-		if offset == 0 {
+		if query.Start == 0 {
 			// if no offset value is given, start with last log
 			initial.Write(last)
 		} else {
 			// otherwise, start at their offset
-			if err := binary.Write(initial, binary.BigEndian, offset); err != nil {
+			if err := binary.Write(initial, binary.BigEndian, query.Start); err != nil {
 				return err
 			}
 		}
 
 		// prepare to end at the specified time (pagination limits still apply)
 		final := &bytes.Buffer{}
-		if err := binary.Write(final, binary.BigEndian, end); err != nil {
+		if err := binary.Write(final, binary.BigEndian, query.End); err != nil {
 			return err
 		}
 
-		// seek boltdb cursor to initial offset
-		k, v := c.Seek(initial.Bytes())
-
-		// if the record's utime (k) doesn't match the specified "initial" value, use previous record.
-		// note: https://github.com/boltdb/bolt/blob/v1.2.0/cursor.go#L114 explains why.
-		// (this step may not be needed if the order of logs returned is reversed)
-		if string(k) != initial.String() {
-			k, v = c.Prev()
+		// seek to initial offset (using an index if the query allows)
+		records := cursor(tx, bucket, query)
+		var k, v []byte
+		step := records.prev
+		// done returns true once the key is past the specified bounds
+		done := func(k []byte) bool { return bytes.Compare(k, final.Bytes()) < 0 }
+		if query.Forward {
+			// read from the end towards the start instead
+			k, v = records.after(final.Bytes())
+			step = records.next
+			done = func(k []byte) bool { return bytes.Compare(k, initial.Bytes()) > 0 }
+		} else {
+			k, v = records.seek(initial.Bytes())
 		}
 
-		// todo: make limit be len(bucket)? if limit < 0
-		for ; k != nil && limit > 0; k, v = c.Prev() {
-			msg := logvac.Message{}
-			oMsg := logvac.OldMessage{} // old message (type has changed for multi-tenancy)
-			// if specified end is reached, be done
-			if string(k) == final.String() {
-				limit = 0
+		for ; k != nil; k, v = step() {
+			// if specified end is passed, be done
+			if done(k) {
+				break
 			}
 
-			// unmarshal to check if match.. seems expensive
-			if err := json.Unmarshal(v, &msg); err != nil {
-				// for backwards compatibility (needed for approx 2 weeks only until old logs get cleaned up)
-				if err2 := json.Unmarshal(v, &oMsg); err2 != nil {
-					return fmt.Errorf("Couldn't unmarshal message - %s - %s", err, err2)
-				}
-				// convert old message to new message for saving
-				msg.Time = oMsg.Time
-				msg.UTime = oMsg.UTime
-				msg.Id = oMsg.Id
-				msg.Tag = []string{oMsg.Tag}
-				msg.Type = oMsg.Type
-				msg.Priority = oMsg.Priority
-				msg.Content = oMsg.Content
-
-				// return fmt.Errorf("Couldn't unmarshal message - %s", err)
+			more, err := fn(k, v)
+			if err != nil {
+				return err
 			}
-
-			if msg.Priority >= level {
-				if host == "" || msg.Id == host {
-					// todo: negate here if tag starts with "!"
-					if len(tag) == 0 {
-						limit--
-
-						// prepend messages with new message (display newest last)
-						messages = append([]logvac.Message{msg}, messages...)
-					} else {
-						for x := range msg.Tag {
-							for y := range tag {
-								if tag[y] == "" || msg.Tag[x] == tag[y] {
-									limit--
-
-									// prepend messages with new message (display newest last)
-									messages = append([]logvac.Message{msg}, messages...)
-
-									return nil
-								}
-							}
-						}
-					}
-				}
+			if !more {
+				break
 			}
 		}
 
 		return nil
 	})
-	if err != nil {
-		return nil, err
+}
+
+// utimeKey returns the key of a log written at utime
+func utimeKey(utime int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(utime))
+	return key
+}
+
+// utime returns the utime a log's key holds
+func utime(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key))
+}
+
+// decode unmarshals a stored message
+func decode(v []byte) (logvac.Message, error) {
+	msg := logvac.Message{}
+	oMsg := logvac.OldMessage{} // old message (type has changed for multi-tenancy)
+
+	if err := json.Unmarshal(v, &msg); err != nil {
+		// for backwards compatibility (needed for approx 2 weeks only until old logs get cleaned up)
+		if err2 := json.Unmarshal(v, &oMsg); err2 != nil {
+			return msg, fmt.Errorf("Couldn't unmarshal message - %s - %s", err, err2)
+		}
+		// convert old message to new message for saving
+		msg.Time = oMsg.Time
+		msg.UTime = oMsg.UTime
+		msg.Id = oMsg.Id
+		msg.Tag = []string{oMsg.Tag}
+		msg.Type = oMsg.Type
+		msg.Priority = oMsg.Priority
+		msg.Content = oMsg.Content
 	}
 
-	// config.Log.Trace("Messages: %+q", messages)
-	return messages, nil
+	return msg, nil
 }
 
 // Write writes the message to database
@@ -173,194 +525,120 @@ func (a *BoltArchive) Write(msg logvac.Message) {
 	// don't archive raw stream
 	msg.Raw = []byte{}
 
+	// keep the db from being swapped out while writing (see Compact)
+	a.wTex.RLock()
+	defer a.wTex.RUnlock()
+
+	db, err := a.partition(msg.Type, msg.UTime)
+	if err != nil {
+		config.Log.Error("Historical write failed - %s", err)
+		return
+	}
+
 	config.Log.Trace("Bolt archive writing...")
-	err := a.db.Batch(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(msg.Type))
-		if err != nil {
-			return err
-		}
+	err = write(db, msg)
+	if err != nil {
+		config.Log.Error("Historical write failed - %s", err)
+		return
+	}
 
-		value, err := json.Marshal(msg)
-		if err != nil {
-			return err
-		}
+	a.track(db, msg)
+	a.wake(msg.Type)
+}
 
-		// this needs to ensure lexographical order
-		key := &bytes.Buffer{}
-		if err = binary.Write(key, binary.BigEndian, msg.UTime); err != nil {
-			return err
-		}
-		if err = bucket.Put(key.Bytes(), value); err != nil {
-			return err
+// Notify returns a channel that is closed once a log of the type (or types, as
+// in Query.Type) is written
+func (a *BoltArchive) Notify(kind string) <-chan bool {
+	a.nTex.Lock()
+	defer a.nTex.Unlock()
+
+	written, ok := a.written[kind]
+	if !ok {
+		written = make(chan bool)
+		a.written[kind] = written
+	}
+	return written
+}
+
+// wake notifies anyone waiting on a log of the type being written
+func (a *BoltArchive) wake(kind string) {
+	a.nTex.Lock()
+	defer a.nTex.Unlock()
+
+	for want, written := range a.written {
+		if matchType(want, kind) {
+			close(written)
+			delete(a.written, want)
 		}
+	}
+}
 
-		return nil
+// write stores a message and indexes it
+func write(db *bolt.DB, msg logvac.Message) error {
+	return db.Batch(func(tx *bolt.Tx) error {
+		return store(tx, msg)
 	})
+}
+
+// store stores a message and indexes it within a transaction
+func store(tx *bolt.Tx, msg logvac.Message) error {
+	// a new type has no logs to index later
+	fresh := tx.Bucket([]byte(msg.Type)) == nil
 
+	bucket, err := tx.CreateBucketIfNotExists([]byte(msg.Type))
 	if err != nil {
-		config.Log.Error("Historical write failed - %s", err)
+		return err
+	}
+
+	value, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	// this needs to ensure lexographical order
+	key := &bytes.Buffer{}
+	if err = binary.Write(key, binary.BigEndian, msg.UTime); err != nil {
+		return err
+	}
+	if err = bucket.Put(key.Bytes(), value); err != nil {
+		return err
+	}
+
+	// keep the id and tag indexes consistent with the logs
+	if err = index(tx, msg, key.Bytes()); err != nil {
+		return err
 	}
+	if err = recordHour(tx, msg); err != nil {
+		return err
+	}
+	if fresh {
+		return typeIndex(tx, msg.Type).Put([]byte(indexDone), []byte("true"))
+	}
+
+	return nil
 }
 
-// Expire cleans up old logs by date or volume of logs
+// Expire cleans up old logs by age, number, or size (see log-keep)
 func (a *BoltArchive) Expire() {
 	// if log-keep is "" expire is disabled
-	if config.LogKeep == "" {
+	if len(a.keep) == 0 {
 		config.Log.Debug("Log expiration disabled")
 		return
 	}
 
-	var logKeep map[string]interface{}
-	err := json.Unmarshal([]byte(config.LogKeep), &logKeep)
-	if err != nil {
-		config.Log.Fatal("Bad JSON syntax for log-keep - %s, saving logs indefinitely", err)
-		return
-	}
-
 	if config.CleanFreq < 1 {
 		config.CleanFreq = 60
 	}
 
-	config.Log.Trace("LogKeep - %v; CleanFreq - %d", logKeep, config.CleanFreq)
+	config.Log.Trace("LogKeep - %s; CleanFreq - %d", config.LogKeep, config.CleanFreq)
 
 	// clean up every minute // todo: maybe 5mins?
 	tick := time.Tick(time.Duration(config.CleanFreq) * time.Second)
 
-	r, _ := regexp.Compile("([0-9]+)([a-za-z]+)")
-	var (
-		NANO_MIN  int64 = 60000000000
-		NANO_HOUR int64 = NANO_MIN * 60
-		NANO_DAY  int64 = NANO_HOUR * 24
-		NANO_WEEK int64 = NANO_DAY * 7
-		NANO_YEAR int64 = NANO_WEEK * 52
-		duration  int64 = NANO_WEEK * 2
-		NANO_SEC  int64 = NANO_MIN / 60
-	)
-
 	for {
 		select {
 		case <-tick:
-			for bucketName, saveAmt := range logKeep { // todo: maybe rather/also loop through buckets
-				config.Log.Trace("bucketName - %s; saveAmt - %v", bucketName, saveAmt)
-				// todo: handle if someone specifies `{"app":"10000"}` (convert to int and fallthrough?)
-				switch saveAmt.(type) {
-				case string:
-					var expireTime = time.Now().UnixNano()
-
-					match := r.FindStringSubmatch(saveAmt.(string)) // "2w"
-					config.Log.Trace("SaveAmt - %v, match - %v", saveAmt, match)
-					if len(match) == 3 {
-						number, err := strconv.ParseInt(match[1], 0, 64)
-						if err != nil {
-							config.Log.Fatal("Bad log-keep - %s", err)
-							number = 2
-						}
-						switch match[2] {
-						case "s": // second // for testing
-							config.Log.Debug("Keeping logs for %d seconds", number)
-							duration = NANO_SEC * number
-						case "m": // minute
-							config.Log.Debug("Keeping logs for %d minutes", number)
-							duration = NANO_MIN * number
-						case "h": // hour
-							config.Log.Debug("Keeping logs for %d hours", number)
-							duration = NANO_HOUR * number
-						case "d": // day
-							config.Log.Debug("Keeping logs for %d days", number)
-							duration = NANO_DAY * number
-						case "w": // week
-							config.Log.Debug("Keeping logs for %d weeks", number)
-							duration = NANO_WEEK * number
-						case "y": // year
-							config.Log.Debug("Keeping logs for %d years", number)
-							duration = NANO_YEAR * number
-						default: // 2 weeks
-							config.Log.Debug("Keeping '%s' logs for 2 weeks", bucketName)
-							duration = NANO_WEEK * 2
-						}
-					}
-
-					expireTime = expireTime - duration
-					eTime := &bytes.Buffer{}
-					if err := binary.Write(eTime, binary.BigEndian, expireTime); err != nil {
-						config.Log.Error("Failed to convert expire time to binary - %s", err.Error())
-						continue
-					}
-
-					config.Log.Debug("Starting age cleanup batch...")
-					a.db.Batch(func(tx *bolt.Tx) error {
-						bucket := tx.Bucket([]byte(bucketName))
-						if bucket == nil {
-							config.Log.Debug("No logs of type '%s' found", bucketName)
-							return fmt.Errorf("No logs of type '%s' found", bucketName)
-						}
-
-						c := bucket.Cursor()
-
-						var err error
-
-						// loop through and remove outdated logs
-						for k, _ := c.First(); k != nil; k, _ = c.Next() {
-							// if logMessage.UTime < expireTime {
-							if bytes.Compare(k, eTime.Bytes()) == -1 {
-								config.Log.Trace("Deleting expired log of type '%s'...", bucketName)
-								err = c.Delete()
-								if err != nil {
-									config.Log.Debug("Failed to delete expired log - %s", err)
-								}
-								config.Log.Trace("Deleted log")
-							} else { // don't continue looping through newer logs (resource/file-lock hog)
-								config.Log.Trace("Done with old logs")
-								break
-							}
-						}
-
-						config.Log.Debug("=======================================")
-						config.Log.Debug("= DONE CHECKING/DELETING EXPIRED LOGS =")
-						config.Log.Debug("=======================================")
-						return nil
-					})
-					config.Log.Trace("Done defining batch")
-				case float64, int:
-					records := int(saveAmt.(float64)) // assertion is slow, do it once (casting is fast)
-
-					config.Log.Debug("Starting record cleanup batch...")
-					a.db.Batch(func(tx *bolt.Tx) error {
-						bucket := tx.Bucket([]byte(bucketName))
-						if bucket == nil {
-							config.Log.Trace("No logs of type '%s' found", bucketName)
-							return fmt.Errorf("No logs of type '%s' found", bucketName)
-						}
-
-						// trim the bucket to size
-						c := bucket.Cursor()
-
-						rSaved := 0
-						// loop through and remove extra logs
-						// if we ever stop ordering by time (oldest first) we'll need to change cursor placement
-						for k, v := c.Last(); k != nil && v != nil; k, v = c.Prev() {
-							rSaved += 1
-							// if the number records we've traversed is larger than our limit, delet the current record
-							if rSaved > records {
-								config.Log.Trace("Deleting extra log of type '%s'...", bucketName)
-								err = c.Delete()
-								if err != nil {
-									config.Log.Trace("Failed to delete extra log - %s", err)
-								}
-							}
-						}
-
-						config.Log.Debug("=======================================")
-						config.Log.Debug("= DONE CHECKING/DELETING EXPIRED LOGS =")
-						config.Log.Debug("=======================================")
-						return nil
-					})
-				default:
-					// todo: we should pre-parse these values and exit on startup, not x minutes into running
-					config.Log.Fatal("Bad log-keep value")
-					os.Exit(1)
-				}
-			} // range logKeep
+			a.ExpireNow()
 		case <-a.Done:
 			config.Log.Debug("Done recieved on channel. (Cleanup halting)")
 			return
@@ -368,11 +646,306 @@ func (a *BoltArchive) Expire() {
 	}
 }
 
+// ExpireNow cleans up old logs once (as Expire does every clean-freq seconds),
+// returning what was removed
+func (a *BoltArchive) ExpireNow() ExpireStats {
+	// don't expire logs while compacting
+	a.maint.Lock()
+	run := ExpireStats{}
+	for _, kind := range a.types("*") {
+		policy, ok := a.keep[kind]
+		if !ok {
+			// types not listed are kept by the default policy, if any
+			if policy, ok = a.keep["*"]; !ok {
+				continue
+			}
+		}
+		deleted, dropped := a.expire(kind, policy)
+		run.Deleted += deleted
+		run.Partitions += dropped
+	}
+	a.maint.Unlock()
+
+	a.sTex.Lock()
+	run.Last = time.Now()
+	run.Total = a.expired.Total + run.Deleted
+	a.expired = run
+	a.sTex.Unlock()
+
+	return run
+}
+
+// expire removes the logs of a type its policy no longer keeps, returning the
+// number of logs and partitions removed
+func (a *BoltArchive) expire(kind string, policy *keepPolicy) (int64, int) {
+	var deleted int64
+	var dropped int
+	now := time.Now().UnixNano()
+
+	// held logs are never removed
+	held, err := a.held(kind)
+	if err != nil {
+		config.Log.Error("Not expiring '%s' logs - %s", kind, err)
+		return 0, 0
+	}
+
+	// only logs already in cold storage (if configured) are removed
+	safe := int64(math.MaxInt64)
+	if a.cold != nil {
+		var err error
+		if safe, err = a.offload(kind, now); err != nil {
+			config.Log.Error("%s", err)
+		}
+	}
+
+	// by age
+	if shortest, longest := policy.ages(); shortest != 0 {
+		if longest != 0 {
+			// whole partitions of expired logs are simply removed
+			logs, parts := a.dropPartitions(kind, earliest(now-longest, safe), held)
+			deleted += logs
+			dropped += parts
+		}
+
+		config.Log.Debug("Starting age cleanup batch...")
+		for _, p := range a.partitions(kind, earliest(now-shortest, safe), 0) {
+			if len(policy.levels) == 0 {
+				deleted += expireAge(p.db, kind, utimeKey(earliest(now-policy.age, safe)), held)
+			} else {
+				deleted += expireLevels(p.db, kind, policy, now, safe, held)
+			}
+		}
+	}
+
+	// by number and size, newest logs first
+	if policy.count >= 0 || policy.bytes > 0 {
+		count, size := policy.count, policy.bytes
+		if count < 0 {
+			count = math.MaxInt64
+		}
+		if size == 0 {
+			size = math.MaxInt64
+		}
+
+		config.Log.Debug("Starting record cleanup batch...")
+		parts := a.partitions(kind, 0, 0)
+		cutoff, err := sizeCutoff(parts, kind, count, size)
+		if err != nil {
+			config.Log.Error("Failed to count '%s' logs - %s", kind, err)
+		} else if cutoff != nil {
+			// everything from the first log that doesn't fit goes
+			before := earliest(utime(cutoff)+1, safe)
+			for _, p := range parts {
+				if p.db != a.db && p.end <= before && !held.overlaps(p.start, p.end) {
+					deleted += a.dropPartition(kind, p)
+					dropped++
+					continue
+				}
+				deleted += expireAge(p.db, kind, utimeKey(before), held)
+			}
+		}
+	}
+
+	return deleted, dropped
+}
+
+// earliest returns the earlier of two times
+func earliest(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// expireAge deletes the logs of a type older than eTime (unless held), returning
+// the number of logs deleted
+func expireAge(db *bolt.DB, bucketName string, eTime []byte, held holds) int64 {
+	var deleted int64
+	db.Batch(func(tx *bolt.Tx) error {
+		deleted = 0
+		bucket := tx.Bucket([]byte(bucketName))
+		if bucket == nil {
+			config.Log.Debug("No logs of type '%s' found", bucketName)
+			return fmt.Errorf("No logs of type '%s' found", bucketName)
+		}
+
+		c := bucket.Cursor()
+
+		var err error
+		cutoff := eTime // index entries before it are pruned
+
+		// loop through and remove outdated logs
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			// if logMessage.UTime < expireTime {
+			if bytes.Compare(k, eTime) == -1 {
+				if held.keeps(k, v) {
+					// keep the index entries of the oldest held log onwards
+					if bytes.Equal(cutoff, eTime) {
+						cutoff = append([]byte{}, k...)
+					}
+					continue
+				}
+				config.Log.Trace("Deleting expired log of type '%s'...", bucketName)
+				err = c.Delete()
+				if err != nil {
+					config.Log.Debug("Failed to delete expired log - %s", err)
+				} else {
+					deleted++
+				}
+				config.Log.Trace("Deleted log")
+			} else { // don't continue looping through newer logs (resource/file-lock hog)
+				config.Log.Trace("Done with old logs")
+				break
+			}
+		}
+
+		if err = pruneIndex(tx, bucketName, cutoff); err != nil {
+			config.Log.Debug("Failed to prune index of expired logs - %s", err)
+		}
+
+		config.Log.Debug("=======================================")
+		config.Log.Debug("= DONE CHECKING/DELETING EXPIRED LOGS =")
+		config.Log.Debug("=======================================")
+		return nil
+	})
+
+	return deleted
+}
+
+// expireLevels deletes the logs of a type (from before `safe`, unless held)
+// older than the age their level is kept for, returning the number of logs
+// deleted
+func expireLevels(db *bolt.DB, kind string, policy *keepPolicy, now, safe int64, held holds) int64 {
+	shortest, longest := policy.ages()
+
+	var deleted int64
+	db.Batch(func(tx *bolt.Tx) error {
+		deleted = 0
+		bucket := tx.Bucket([]byte(kind))
+		if bucket == nil {
+			config.Log.Trace("No logs of type '%s' found", kind)
+			return nil
+		}
+
+		// logs older than the longest age are removed whatever their level,
+		// logs between the shortest and longest ages depend on their level
+		var expired []logvac.Message
+		var keys [][]byte
+		cutoff := earliest(now-longest, safe) // index entries before it are pruned
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil && utime(k) < earliest(now-shortest, safe); k, v = c.Next() {
+			if held.keeps(k, v) {
+				cutoff = earliest(cutoff, utime(k))
+				continue
+			}
+			if longest != 0 && utime(k) < now-longest {
+				keys = append(keys, append([]byte{}, k...))
+				continue
+			}
+			msg, err := decodeHeader(v, false)
+			if err != nil {
+				config.Log.Debug("Failed to decode log - %s", err)
+				continue
+			}
+			if age := policy.ageOf(msg.Priority); age != 0 && msg.UTime < now-age {
+				keys = append(keys, append([]byte{}, k...))
+				expired = append(expired, msg)
+			}
+		}
+
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				config.Log.Debug("Failed to delete expired log - %s", err)
+				continue
+			}
+			deleted++
+		}
+
+		if longest != 0 {
+			if err := pruneIndex(tx, kind, utimeKey(cutoff)); err != nil {
+				config.Log.Debug("Failed to prune index of expired logs - %s", err)
+			}
+		}
+		for _, msg := range expired {
+			if err := unindex(tx, kind, msg, utimeKey(msg.UTime)); err != nil {
+				config.Log.Debug("Failed to unindex expired log - %s", err)
+			}
+		}
+
+		return nil
+	})
+
+	return deleted
+}
+
+// sizeCutoff returns the key of the newest log of a type beyond the newest
+// `records` logs (holding up to `size` bytes), or nil if every log fits. Logs
+// are counted newest first across the partitions (as partitions returns them),
+// merging any that overlap.
+func sizeCutoff(parts []*partition, kind string, records, size int64) ([]byte, error) {
+	type head struct {
+		c    *bolt.Cursor
+		k, v []byte
+	}
+	var heads []*head
+	var txs []*bolt.Tx
+	defer func() {
+		for _, tx := range txs {
+			tx.Rollback()
+		}
+	}()
+
+	var kept, keptBytes int64
+	next := 0
+	for {
+		// the newest log not yet counted
+		var newest *head
+		for _, h := range heads {
+			if h.k != nil && (newest == nil || bytes.Compare(h.k, newest.k) > 0) {
+				newest = h
+			}
+		}
+
+		// open the partitions that may hold newer logs
+		if next < len(parts) && (newest == nil || parts[next].end > utime(newest.k)) {
+			tx, err := parts[next].db.Begin(false)
+			next++
+			if err == bolt.ErrDatabaseNotOpen {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			txs = append(txs, tx)
+			if bucket := tx.Bucket([]byte(kind)); bucket != nil {
+				h := &head{c: bucket.Cursor()}
+				h.k, h.v = h.c.Last()
+				heads = append(heads, h)
+			}
+			continue
+		}
+
+		if newest == nil {
+			return nil, nil
+		}
+		if kept >= records || keptBytes+int64(len(newest.v)) > size {
+			return append([]byte{}, newest.k...), nil
+		}
+		kept++
+		keptBytes += int64(len(newest.v))
+		newest.k, newest.v = newest.c.Prev()
+	}
+}
+
 // Save writes a value to the database
 func (a *BoltArchive) Save(db, key string, v interface{}) error {
 	config.Log.Trace("Saving...")
 
-	err := a.db.Batch(func(tx *bolt.Tx) error {
+	// compacting would lose the write (only logs are tracked)
+	a.maint.Lock()
+	defer a.maint.Unlock()
+
+	err := a.db.Update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists([]byte(db))
 		if err != nil {
 			return err
@@ -3,10 +3,21 @@
 package drain_test
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/jcelliott/lumber"
 
 	"github.com/nanopack/logvac/config"
@@ -60,50 +71,1221 @@ func TestWrite(t *testing.T) {
 	drain.Archiver.Write(messages[1])
 
 	// test successful write
-	appMsgs, err := drain.Archiver.Slice("app", "", []string{""}, 0, 0, 100, 0)
+	appMsgs, err := drain.Archiver.Slice(drain.Query{Type: "app", Tag: []string{""}, Limit: 100})
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
 	}
 	// compare written message to original
 	if len(appMsgs) != 1 || appMsgs[0].Content != messages[0].Content {
-		t.Errorf("%q doesn't match expected out", appMsgs)
+		t.Errorf("%+v doesn't match expected out", appMsgs)
 		t.FailNow()
 	}
 }
 
+// Test searching log content
+func TestSliceContent(t *testing.T) {
+	now := time.Now().UnixNano()
+	contents := []string{"GET /health 200", "GET /users 500 Internal Error", "POST /users 201", "GET /health 200", "worker error: timeout"}
+	for i := range contents {
+		drain.Archiver.Write(logvac.Message{
+			Time:     time.Now(),
+			UTime:    now + int64(i),
+			Id:       "searchhost",
+			Tag:      []string{"search"},
+			Type:     "search",
+			Priority: 2,
+			Content:  contents[i],
+		})
+	}
+
+	tests := []struct {
+		query    drain.Query
+		expected []string
+	}{
+		{drain.Query{Content: "/users"}, []string{contents[1], contents[2]}},
+		{drain.Query{Content: "error"}, []string{contents[4]}},
+		{drain.Query{Content: "error", IgnoreCase: true}, []string{contents[1], contents[4]}},
+		{drain.Query{Regexp: regexp.MustCompile(` 5\d\d `)}, []string{contents[1]}},
+		{drain.Query{Content: "GET", Limit: 2}, []string{contents[1], contents[3]}},
+		{drain.Query{Content: "POST", Limit: 1, ScanLimit: 2}, []string{}},
+		{drain.Query{Content: "POST", Limit: 1, ScanLimit: 3}, []string{contents[2]}},
+		{drain.Query{Tag: []string{"search"}, End: now + 3}, []string{contents[3], contents[4]}},
+	}
+
+	for i, test := range tests {
+		test.query.Type = "search"
+		if test.query.Limit == 0 {
+			test.query.Limit = 100
+		}
+		msgs, err := drain.Archiver.Slice(test.query)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if len(msgs) != len(test.expected) {
+			t.Errorf("%d: %+v doesn't match expected out", i, msgs)
+			continue
+		}
+		for j := range msgs {
+			if msgs[j].Content != test.expected[j] {
+				t.Errorf("%d: %+v doesn't match expected out", i, msgs)
+			}
+		}
+	}
+}
+
 // Test expiring/cleanup of data
+func TestSliceIndex(t *testing.T) {
+	now := time.Now().UnixNano()
+	logs := []struct {
+		id  string
+		tag []string
+	}{
+		{"web", []string{"nginx"}},
+		{"db", []string{"postgres", "slow"}},
+		{"web", []string{"nginx", "slow"}},
+		{"worker", nil},
+		{"db", []string{"postgres"}},
+	}
+	for i := range logs {
+		drain.Archiver.Write(logvac.Message{
+			Time:     time.Now(),
+			UTime:    now + int64(i),
+			Id:       logs[i].id,
+			Tag:      logs[i].tag,
+			Type:     "indexed",
+			Priority: 2,
+			Content:  fmt.Sprintf("log %d", i),
+		})
+	}
+
+	tests := []struct {
+		query    drain.Query
+		expected []string
+	}{
+		{drain.Query{Id: []string{"db"}}, []string{"log 1", "log 4"}},
+		{drain.Query{Id: []string{"worker"}}, []string{"log 3"}},
+		{drain.Query{Id: []string{"nobody"}}, []string{}},
+		{drain.Query{Tag: []string{"slow"}}, []string{"log 1", "log 2"}},
+		{drain.Query{Tag: []string{"nginx", "slow"}}, []string{"log 0", "log 1", "log 2"}},
+		{drain.Query{Tag: []string{"nginx", "slow"}, Limit: 2}, []string{"log 1", "log 2"}},
+		{drain.Query{Id: []string{"db"}, Tag: []string{"slow"}}, []string{"log 1"}},
+		{drain.Query{Id: []string{"web"}, Start: now + 1}, []string{"log 0"}},
+		{drain.Query{Tag: []string{"nginx", "slow"}, Limit: 2, Forward: true}, []string{"log 0", "log 1"}},
+		{drain.Query{Id: []string{"db"}, End: now + 2, Forward: true}, []string{"log 4"}},
+	}
+
+	for i, test := range tests {
+		test.query.Type = "indexed"
+		if test.query.Limit == 0 {
+			test.query.Limit = 100
+		}
+		msgs, err := drain.Archiver.Slice(test.query)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if len(msgs) != len(test.expected) {
+			t.Errorf("%d: %+v doesn't match expected out", i, msgs)
+			continue
+		}
+		for j := range msgs {
+			if msgs[j].Content != test.expected[j] {
+				t.Errorf("%d: %+v doesn't match expected out", i, msgs)
+			}
+		}
+	}
+}
+
+// Test excluding, multiple, and pattern id/tag filters
+func TestSliceFilters(t *testing.T) {
+	now := time.Now().UnixNano()
+	logs := []struct {
+		id  string
+		tag []string
+	}{
+		{"web-1", []string{"nginx[access]"}},
+		{"web-2", []string{"nginx[error]"}},
+		{"web-1", []string{"healthcheck"}},
+		{"db-1", []string{"postgres"}},
+		{"worker", nil},
+	}
+	for i := range logs {
+		drain.Archiver.Write(logvac.Message{
+			Time:     time.Now(),
+			UTime:    now + int64(i),
+			Id:       logs[i].id,
+			Tag:      logs[i].tag,
+			Type:     "filters",
+			Priority: 2,
+			Content:  fmt.Sprintf("log %d", i),
+		})
+	}
+
+	tests := []struct {
+		query    drain.Query
+		expected []string
+	}{
+		{drain.Query{Tag: []string{"!healthcheck"}}, []string{"log 0", "log 1", "log 3", "log 4"}},
+		{drain.Query{Tag: []string{"!nginx[access]", "!healthcheck"}}, []string{"log 1", "log 3", "log 4"}},
+		{drain.Query{Tag: []string{"nginx*"}}, []string{"log 0", "log 1"}},
+		{drain.Query{Tag: []string{"*[error]", "postgres"}}, []string{"log 1", "log 3"}},
+		{drain.Query{Tag: []string{"nginx*", "!*access*"}}, []string{"log 1"}},
+		{drain.Query{Id: []string{"web-2", "db-1"}}, []string{"log 1", "log 3"}},
+		{drain.Query{Id: []string{"!web-1"}}, []string{"log 1", "log 3", "log 4"}},
+		{drain.Query{Id: []string{"web-*"}, Tag: []string{"!healthcheck"}}, []string{"log 0", "log 1"}},
+		{drain.Query{Id: []string{"*-1", "!db*"}}, []string{"log 0", "log 2"}},
+	}
+
+	for i, test := range tests {
+		test.query.Type = "filters"
+		test.query.Limit = 100
+		msgs, err := drain.Archiver.Slice(test.query)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if len(msgs) != len(test.expected) {
+			t.Errorf("%d: %+v doesn't match expected out", i, msgs)
+			continue
+		}
+		for j := range msgs {
+			if msgs[j].Content != test.expected[j] {
+				t.Errorf("%d: %+v doesn't match expected out", i, msgs)
+			}
+		}
+	}
+}
+
+// Test merging the logs of several types
+func TestSliceTypes(t *testing.T) {
+	now := time.Now().UnixNano()
+	for i := 0; i < 6; i++ {
+		drain.Archiver.Write(logvac.Message{
+			Time:     time.Now(),
+			UTime:    now + int64(i),
+			Id:       "mergehost",
+			Type:     fmt.Sprintf("merge%d", i%3),
+			Priority: 2,
+			Content:  fmt.Sprintf("log %d", i),
+		})
+	}
+
+	tests := []struct {
+		query    drain.Query
+		expected []string
+	}{
+		{drain.Query{Type: "merge0,merge1", Limit: 100}, []string{"log 0", "log 1", "log 3", "log 4"}},
+		{drain.Query{Type: "merge0,merge2", Limit: 3}, []string{"log 2", "log 3", "log 5"}},
+		{drain.Query{Type: "merge0,merge2", Limit: 3, Forward: true}, []string{"log 0", "log 2", "log 3"}},
+		{drain.Query{Type: "merge1,merge2", Start: now + 3, Limit: 2}, []string{"log 1", "log 2"}},
+		{drain.Query{Type: "*", Id: []string{"mergehost"}, Limit: 100}, []string{"log 0", "log 1", "log 2", "log 3", "log 4", "log 5"}},
+	}
+
+	for i, test := range tests {
+		msgs, err := drain.Archiver.Slice(test.query)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if len(msgs) != len(test.expected) {
+			t.Errorf("%d: %+v doesn't match expected out", i, msgs)
+			continue
+		}
+		for j := range msgs {
+			if msgs[j].Content != test.expected[j] {
+				t.Errorf("%d: %+v doesn't match expected out", i, msgs)
+			}
+		}
+	}
+}
+
+// Test counting logs over time
+func TestHistogram(t *testing.T) {
+	minute := int64(time.Minute)
+	base := time.Now().Add(-time.Hour).UnixNano() / minute * minute
+	logs := []struct {
+		utime    int64
+		id       string
+		priority int
+	}{
+		{base, "a", 2},
+		{base + 10*int64(time.Second), "a", 3},
+		{base + 70*int64(time.Second), "b", 3},
+		{base + 190*int64(time.Second), "a", 4},
+	}
+	for i := range logs {
+		drain.Archiver.Write(logvac.Message{
+			Time:     time.Unix(0, logs[i].utime),
+			UTime:    logs[i].utime,
+			Id:       logs[i].id,
+			Type:     "histogram",
+			Priority: logs[i].priority,
+			Content:  fmt.Sprintf("log %d", i),
+		})
+	}
+
+	buckets, err := drain.Archiver.Histogram(drain.Query{Type: "histogram"}, minute, "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	counts := []int64{}
+	for i := range buckets {
+		counts = append(counts, buckets[i].Count)
+	}
+	if fmt.Sprint(counts) != "[2 1 0 1]" || buckets[0].Time != base {
+		t.Errorf("%+v doesn't match expected out", buckets)
+	}
+
+	buckets, err = drain.Archiver.Histogram(drain.Query{Type: "histogram", Level: 3}, minute, "level")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(buckets) != 4 || buckets[0].Count != 1 || buckets[0].Groups["warn"] != 1 || buckets[3].Groups["error"] != 1 {
+		t.Errorf("%+v doesn't match expected out", buckets)
+	}
+
+	// bounded by the query, grouped by id
+	buckets, err = drain.Archiver.Histogram(drain.Query{Type: "histogram", Start: base + 5*minute, End: base + minute}, minute, "id")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(buckets) != 5 || buckets[0].Groups["b"] != 1 || buckets[2].Groups["a"] != 1 || buckets[4].Count != 0 {
+		t.Errorf("%+v doesn't match expected out", buckets)
+	}
+
+	if _, err = drain.Archiver.Histogram(drain.Query{Type: "histogram"}, minute, "host"); err == nil {
+		t.Error("bad group is too forgiving")
+	}
+}
+
+// Test reading and expiring logs once partitioning is turned off
+func TestPartitionOff(t *testing.T) {
+	hour := int64(time.Hour)
+	now := time.Now().UnixNano()
+	partition, keep := config.Partition, config.LogKeep
+	defer func() {
+		config.Partition, config.LogKeep = partition, keep
+	}()
+	config.LogKeep = `{"unparted": 2}`
+
+	// logs from before partitioning, while partitioning, and since turned off
+	for _, run := range []struct {
+		partition string
+		ages      []int64
+	}{
+		{"", []int64{5}},
+		{"1h", []int64{3, 2}},
+		{"", []int64{1, 0}},
+	} {
+		config.Partition = run.partition
+		archive, err := drain.NewBoltArchive("/tmp/boltdbTest/unparted.bolt")
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if err = archive.Init(); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		for _, age := range run.ages {
+			archive.Write(logvac.Message{
+				Time:    time.Unix(0, now-age*hour),
+				UTime:   now - age*hour,
+				Type:    "unparted",
+				Content: fmt.Sprintf("%dh ago", age),
+			})
+		}
+		archive.Close()
+	}
+
+	archive, err := drain.NewBoltArchive("/tmp/boltdbTest/unparted.bolt")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer archive.Close()
+	if err = archive.Init(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	tests := []struct {
+		query    drain.Query
+		expected []string
+	}{
+		{drain.Query{Type: "unparted", Limit: 3}, []string{"2h ago", "1h ago", "0h ago"}},
+		{drain.Query{Type: "unparted", Limit: 2, Forward: true}, []string{"5h ago", "3h ago"}},
+		{drain.Query{Type: "unparted", Limit: 10}, []string{"5h ago", "3h ago", "2h ago", "1h ago", "0h ago"}},
+	}
+	for _, test := range tests {
+		msgs, err := archive.Slice(test.query)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if len(msgs) != len(test.expected) {
+			t.Errorf("%+v doesn't match expected out", msgs)
+			continue
+		}
+		for i := range msgs {
+			if msgs[i].Content != test.expected[i] {
+				t.Errorf("%+v doesn't match expected out", msgs)
+				break
+			}
+		}
+	}
+
+	// the newest logs are kept, whichever file they're in
+	go archive.Expire()
+	time.Sleep(1500 * time.Millisecond)
+	archive.Done <- true
+
+	msgs, err := archive.Slice(drain.Query{Type: "unparted", Limit: 10})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msgs) != 2 || msgs[0].Content != "1h ago" || msgs[1].Content != "0h ago" {
+		t.Errorf("%+v doesn't match expected out", msgs)
+	}
+	// (the partition of the newest log removed is emptied rather than removed)
+	files, _ := filepath.Glob("/tmp/boltdbTest/unparted.partitions/unparted/*.bolt")
+	if len(files) > 1 {
+		t.Errorf("Expected expired partitions to be removed, got %q", files)
+	}
+}
+
+// Test describing what the archive holds
+func TestStats(t *testing.T) {
+	now := time.Now().UnixNano()
+	ids := []string{"talker", "quiet", "talker", "talker", "quiet", "once"}
+	for i := range ids {
+		drain.Archiver.Write(logvac.Message{
+			Time:     time.Now(),
+			UTime:    now + int64(i),
+			Id:       ids[i],
+			Type:     "counted",
+			Priority: 2,
+			Content:  fmt.Sprintf("log %d", i),
+		})
+	}
+
+	stats, err := drain.Stats(2)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	counted, ok := stats.Types["counted"]
+	if !ok {
+		t.Errorf("%+v doesn't match expected out", stats)
+		t.FailNow()
+	}
+	if counted.Count != 6 || counted.Oldest != now || counted.Newest != now+5 {
+		t.Errorf("%+v doesn't match expected out", counted)
+	}
+	if fmt.Sprint(counted.TopIds) != "[{talker 3} {quiet 2}]" {
+		t.Errorf("%+v doesn't match expected out", counted.TopIds)
+	}
+	if stats.Files == 0 || stats.Bytes == 0 {
+		t.Errorf("%+v doesn't match expected out", stats)
+	}
+	if _, ok := stats.Types["_index"]; ok {
+		t.Errorf("%+v shouldn't include the index", stats)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	day := int64(24 * time.Hour)
+	now := time.Now().UnixNano()
+	for i := int64(0); i < 4; i++ {
+		utime := now - (3-i)*day
+		drain.Archiver.Write(logvac.Message{
+			Time:     time.Unix(0, utime),
+			UTime:    utime,
+			Id:       "parthost",
+			Tag:      []string{"part"},
+			Type:     "parted",
+			Priority: 2,
+			Content:  fmt.Sprintf("day %d", i),
+		})
+	}
+
+	// each day is stored in its own file
+	files, err := filepath.Glob("/tmp/boltdbTest/logvac.partitions/parted/*.bolt")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(files) != 4 {
+		t.Errorf("Expected 4 partitions, got %q", files)
+	}
+
+	tests := []struct {
+		query    drain.Query
+		expected []string
+	}{
+		{drain.Query{}, []string{"day 0", "day 1", "day 2", "day 3"}},
+		{drain.Query{Limit: 3}, []string{"day 1", "day 2", "day 3"}},
+		{drain.Query{Start: now - day}, []string{"day 0", "day 1", "day 2"}},
+		{drain.Query{End: now - 2*day}, []string{"day 1", "day 2", "day 3"}},
+		{drain.Query{Start: now - day, End: now - 2*day, Limit: 1}, []string{"day 2"}},
+		{drain.Query{Forward: true, Limit: 3}, []string{"day 0", "day 1", "day 2"}},
+		{drain.Query{Forward: true, End: now - 2*day, Limit: 2}, []string{"day 1", "day 2"}},
+		{drain.Query{Forward: true, Start: now - day, End: now - 2*day}, []string{"day 1", "day 2"}},
+	}
+
+	for i, test := range tests {
+		test.query.Type = "parted"
+		if test.query.Limit == 0 {
+			test.query.Limit = 100
+		}
+		msgs, err := drain.Archiver.Slice(test.query)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if len(msgs) != len(test.expected) {
+			t.Errorf("%d: %+v doesn't match expected out", i, msgs)
+			continue
+		}
+		for j := range msgs {
+			if msgs[j].Content != test.expected[j] {
+				t.Errorf("%d: %+v doesn't match expected out", i, msgs)
+			}
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	now := time.Now().UnixNano()
+
+	// enough logs to need several batches (concurrent writes share commits)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				drain.Archiver.Write(logvac.Message{
+					Time:     time.Now(),
+					UTime:    now + int64(i*50+j),
+					Id:       "walkhost",
+					Type:     "walked",
+					Priority: 2,
+					Content:  "walk",
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, forward := range []bool{false, true} {
+		var walked []int64
+		err := drain.Archiver.Walk(drain.Query{Type: "walked", Limit: 2400, Forward: forward}, func(msg logvac.Message) error {
+			walked = append(walked, msg.UTime)
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if len(walked) != 2400 {
+			t.Errorf("Expected 2400 logs, got %d", len(walked))
+			continue
+		}
+		for i := 1; i < len(walked); i++ {
+			if (forward && walked[i] != walked[i-1]+1) || (!forward && walked[i] != walked[i-1]-1) {
+				t.Errorf("Logs walked out of order at %d", i)
+				break
+			}
+		}
+		if (forward && walked[0] != now) || (!forward && walked[0] != now+2499) {
+			t.Errorf("Walk started at the wrong log")
+		}
+	}
+
+	// types logged at the same time aren't skipped between batches
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 60; j++ {
+				for _, kind := range []string{"walka", "walkb", "walkc"} {
+					drain.Archiver.Write(logvac.Message{
+						Time:     time.Now(),
+						UTime:    now + int64(i*60+j),
+						Id:       "walkhost",
+						Type:     kind,
+						Priority: 2,
+						Content:  "walk",
+					})
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, forward := range []bool{false, true} {
+		walked := map[string]int{}
+		err := drain.Archiver.Walk(drain.Query{Type: "walka,walkb,walkc", Limit: 3600, Forward: forward}, func(msg logvac.Message) error {
+			walked[fmt.Sprintf("%s-%d", msg.Type, msg.UTime)]++
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if len(walked) != 3600 {
+			t.Errorf("Expected 3600 distinct logs, got %d", len(walked))
+		}
+		for key, n := range walked {
+			if n != 1 {
+				t.Errorf("Log %s walked %d times", key, n)
+				break
+			}
+		}
+	}
+
+	// walking stops on error
+	count := 0
+	err := drain.Archiver.Walk(drain.Query{Type: "walked", Limit: 2500}, func(msg logvac.Message) error {
+		count++
+		if count == 10 {
+			return fmt.Errorf("stop")
+		}
+		return nil
+	})
+	if err == nil || count != 10 {
+		t.Errorf("Walk didn't stop on error")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	now := time.Now().UnixNano()
+	write := func(i int) {
+		drain.Archiver.Write(logvac.Message{
+			Time:     time.Now(),
+			UTime:    now + int64(i),
+			Id:       "compacthost",
+			Tag:      []string{"compact"},
+			Type:     "compacted",
+			Priority: 2,
+			Content:  fmt.Sprintf("log %d", i),
+		})
+	}
+	for i := 0; i < 100; i++ {
+		write(i)
+	}
+
+	// copied a few logs per transaction
+	chunk := *drain.CompactTxSize
+	*drain.CompactTxSize = 1024
+	defer func() { *drain.CompactTxSize = chunk }()
+
+	// logs (and anything else) written while compacting must not be lost
+	done := make(chan bool)
+	go func() {
+		for i := 100; i < 200; i++ {
+			write(i)
+		}
+		done <- true
+	}()
+	placed := make(chan error)
+	go func() {
+		_, err := drain.PlaceHold(drain.Hold{Type: "compacted", From: now + 1000, Reason: "placed while compacting"})
+		placed <- err
+	}()
+
+	stats, err := drain.Compact()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	<-done
+	if err = <-placed; err != nil {
+		t.Error(err)
+	}
+	holds, err := drain.Holds()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(holds) != 1 || holds[0].Reason != "placed while compacting" {
+		t.Errorf("Hold placed while compacting was lost - %+v", holds)
+		t.FailNow()
+	}
+
+	// nor are holds released while compacting
+	released := make(chan error)
+	go func() {
+		released <- drain.ReleaseHold(holds[0].Id)
+	}()
+	if _, err = drain.Compact(); err != nil {
+		t.Error(err)
+	}
+	if err = <-released; err != nil {
+		t.Error(err)
+	}
+	if holds, err = drain.Holds(); err != nil || len(holds) != 0 {
+		t.Errorf("Hold released while compacting came back - %+v %v", holds, err)
+	}
+
+	if stats.Files < 2 || stats.Before == 0 || stats.After == 0 {
+		t.Errorf("%+v doesn't match expected out", stats)
+	}
+
+	msgs, err := drain.Archiver.Slice(drain.Query{Type: "compacted", Id: []string{"compacthost"}, Limit: 1000})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msgs) != 200 {
+		t.Errorf("Expected 200 logs, got %d", len(msgs))
+	}
+
+	// the archive is still writable
+	write(200)
+	msgs, err = drain.Archiver.Slice(drain.Query{Type: "compacted", Limit: 1})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msgs) != 1 || msgs[0].Content != "log 200" {
+		t.Errorf("%+v doesn't match expected out", msgs)
+	}
+}
+
+// Test dumping and restoring logs
+func TestDumpRestore(t *testing.T) {
+	now := time.Now().UnixNano()
+	for i := int64(0); i < 3; i++ {
+		drain.Archiver.Write(logvac.Message{
+			Time:    time.Unix(0, now+i),
+			UTime:   now + i,
+			Id:      "dumper",
+			Tag:     []string{"dump"},
+			Type:    "dumped",
+			Content: fmt.Sprintf("dump %d", i),
+		})
+	}
+
+	dump := &bytes.Buffer{}
+	dumped, err := drain.Dump(dump, drain.Query{Type: "dumped", End: now + 1}, true)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if dumped != 2 {
+		t.Errorf("Expected 2 logs dumped, got %d", dumped)
+	}
+
+	archive, err := drain.NewBoltArchive("/tmp/boltdbTest/restore.bolt")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer archive.Close()
+	if err = archive.Init(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// gzipped dumps
+	restored, err := archive.Restore(dump)
+	if err != nil || restored != 2 {
+		t.Errorf("Failed to restore (%d logs) - %v", restored, err)
+	}
+
+	// plain dumps, with old style messages
+	old := fmt.Sprintf(`{"time":"%s","utime":%d,"id":"dumper","tag":"old","type":"dumped","priority":2,"message":"old"}`+"\n",
+		time.Unix(0, now-1).Format(time.RFC3339Nano), now-1)
+	restored, err = archive.Restore(strings.NewReader(old))
+	if err != nil || restored != 1 {
+		t.Errorf("Failed to restore (%d logs) - %v", restored, err)
+	}
+
+	msgs, err := archive.Slice(drain.Query{Type: "dumped", Limit: 100})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msgs) != 3 || msgs[0].Content != "old" || msgs[0].Tag[0] != "old" ||
+		msgs[1].UTime != now+1 || msgs[2].UTime != now+2 || msgs[2].Tag[0] != "dump" {
+		t.Errorf("%+v doesn't match expected out", msgs)
+	}
+
+	if _, err = archive.Restore(strings.NewReader("{\"message\":\"no type\"}\n")); err == nil {
+		t.Error("Restored a log without a type")
+	}
+}
+
+// Test snapshotting the archive for backups
+func TestSnapshot(t *testing.T) {
+	var names []string
+	err := drain.Snapshot(func(name string, tx *bolt.Tx) error {
+		names = append(names, name)
+		if tx.Size() == 0 {
+			return fmt.Errorf("Empty snapshot of '%s'", name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(names) < 2 || names[0] != "archive.bolt" || !strings.HasPrefix(names[1], "archive.partitions/") {
+		t.Errorf("%q doesn't match expected out", names)
+	}
+
+	for name, expected := range map[string]string{
+		"archive.bolt":                    "/tmp/boltdbTest/logvac.bolt",
+		"archive.partitions/app/1-2.bolt": "/tmp/boltdbTest/logvac.partitions/app/1-2.bolt",
+		"drains.bolt":                     "/tmp/boltdbTest/drains.bolt",
+		"auth.bolt":                       "",
+		"archive.partitions/../../etc/passwd.bolt": "error",
+	} {
+		path, err := drain.SnapshotPath(name)
+		if err != nil {
+			path = "error"
+		}
+		if path != expected {
+			t.Errorf("Expected '%s' restored to '%s', got '%s'", name, expected, path)
+		}
+	}
+}
+
+// Test offloading logs to cold storage before expiring them
+func TestColdStorage(t *testing.T) {
+	// s3 stand-in (uploads of 'warm' logs fail)
+	objects := map[string][]byte{}
+	mu := sync.Mutex{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			rw.WriteHeader(403)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case req.Method == "PUT" && strings.Contains(req.URL.Path, "/warm/"):
+			rw.WriteHeader(500)
+		case req.Method == "PUT":
+			objects[req.URL.Path], _ = ioutil.ReadAll(req.Body)
+		case req.Method == "DELETE":
+			delete(objects, req.URL.Path)
+			rw.WriteHeader(204)
+		case req.URL.Query().Get("list-type") == "2":
+			// a key per page
+			var keys []string
+			for path := range objects {
+				key := strings.TrimPrefix(path, req.URL.Path+"/")
+				if strings.HasPrefix(key, req.URL.Query().Get("prefix")) && key > req.URL.Query().Get("continuation-token") {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			if len(keys) == 0 {
+				fmt.Fprint(rw, "<ListBucketResult></ListBucketResult>")
+				return
+			}
+			fmt.Fprintf(rw, "<ListBucketResult><Contents><Key>%s</Key></Contents><IsTruncated>%t</IsTruncated><NextContinuationToken>%s</NextContinuationToken></ListBucketResult>",
+				keys[0], len(keys) > 1, keys[0])
+		default:
+			body, ok := objects[req.URL.Path]
+			if !ok {
+				rw.WriteHeader(404)
+				return
+			}
+			rw.Write(body)
+		}
+	}))
+	defer server.Close()
+
+	coldAddress, logKeep := config.ColdAddress, config.LogKeep
+	defer func() { config.ColdAddress, config.LogKeep = coldAddress, logKeep }()
+	config.ColdAddress = "s3://key:secret@" + strings.TrimPrefix(server.URL, "http://") + "/logs/archive?insecure=true"
+	config.LogKeep = `{"cold":"1h", "warm":"1h"}`
+
+	archive, err := drain.NewBoltArchive("/tmp/boltdbTest/cold.bolt")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer archive.Close()
+	if err = archive.Init(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	hour := int64(time.Hour)
+	now := time.Now().UnixNano()
+	for i, utime := range []int64{now - 3*hour, now - 3*hour + 1, now - 2*hour, now} {
+		archive.Write(logvac.Message{Type: "cold", UTime: utime, Time: time.Unix(0, utime), Content: fmt.Sprintf("log %d", i)})
+	}
+	archive.Write(logvac.Message{Type: "warm", UTime: now - 2*hour, Time: time.Unix(0, now-2*hour), Content: "warm"})
+
+	go archive.Expire()
+	time.Sleep(1500 * time.Millisecond)
+	archive.Done <- true
+
+	// old logs are offloaded (an object per hour) then expired
+	msgs, err := archive.Slice(drain.Query{Type: "cold", Limit: 10})
+	if err != nil || len(msgs) != 1 || msgs[0].Content != "log 3" {
+		t.Errorf("%+v doesn't match expected out - %v", msgs, err)
+	}
+	mu.Lock()
+	if len(objects) != 2 {
+		t.Errorf("Expected 2 objects offloaded, got %d", len(objects))
+	}
+	mu.Unlock()
+
+	// logs that failed to offload are kept
+	msgs, err = archive.Slice(drain.Query{Type: "warm", Limit: 10})
+	if err != nil || len(msgs) != 1 {
+		t.Errorf("%+v doesn't match expected out - %v", msgs, err)
+	}
+
+	// offloaded logs are read back
+	for _, test := range []struct {
+		query    drain.Query
+		expected []string
+	}{
+		{drain.Query{Type: "cold", Limit: 10}, []string{"log 0", "log 1", "log 2"}},
+		{drain.Query{Type: "cold", Limit: 1}, []string{"log 2"}},
+		{drain.Query{Type: "cold", Limit: 1, Forward: true}, []string{"log 0"}},
+		{drain.Query{Type: "cold", Limit: 10, Start: now - 3*hour}, []string{"log 0"}},
+		{drain.Query{Type: "cold", Limit: 10, Content: "log 1"}, []string{"log 1"}},
+	} {
+		msgs, err := archive.SliceCold(test.query)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		contents := []string{}
+		for i := range msgs {
+			contents = append(contents, msgs[i].Content)
+		}
+		if fmt.Sprint(contents) != fmt.Sprint(test.expected) {
+			t.Errorf("%+v read %q, expected %q", test.query, contents, test.expected)
+		}
+	}
+
+	// purging removes offloaded logs too (held ones are kept)
+	if _, err = archive.PlaceHold(drain.Hold{Type: "cold", From: now - 3*hour, To: now - 3*hour, Reason: "kept"}); err != nil {
+		t.Error(err)
+	}
+	record, err := archive.Purge(drain.Query{Type: "cold", Content: "log"}, drain.PurgeRecord{DryRun: true})
+	if err != nil || record.Cold != 2 || record.Deleted != 1 {
+		t.Errorf("%+v doesn't match expected out - %v", record, err)
+	}
+	record, err = archive.Purge(drain.Query{Type: "cold", Content: "log"}, drain.PurgeRecord{})
+	if err != nil || record.Cold != 2 || record.Deleted != 1 {
+		t.Errorf("%+v doesn't match expected out - %v", record, err)
+	}
+	msgs, err = archive.SliceCold(drain.Query{Type: "cold", Limit: 10})
+	if err != nil || len(msgs) != 1 || msgs[0].Content != "log 0" {
+		t.Errorf("%+v doesn't match expected out - %v", msgs, err)
+	}
+	// emptied objects are deleted
+	mu.Lock()
+	if len(objects) != 1 {
+		t.Errorf("Expected 1 object left, got %d", len(objects))
+	}
+	mu.Unlock()
+
+	// logs written to hours already offloaded are offloaded with them before expiring
+	archive.Write(logvac.Message{Type: "cold", UTime: now - 3*hour + 2, Time: time.Unix(0, now-3*hour+2), Content: "late"})
+	archive.Write(logvac.Message{Type: "cold", UTime: now - 2*hour, Time: time.Unix(0, now-2*hour), Content: "later"})
+
+	go archive.Expire()
+	time.Sleep(1500 * time.Millisecond)
+	archive.Done <- true
+
+	// (the rest were purged)
+	msgs, err = archive.Slice(drain.Query{Type: "cold", Limit: 10})
+	if err != nil || len(msgs) != 0 {
+		t.Errorf("%+v doesn't match expected out - %v", msgs, err)
+	}
+	msgs, err = archive.SliceCold(drain.Query{Type: "cold", Limit: 10})
+	contents := []string{}
+	for i := range msgs {
+		contents = append(contents, msgs[i].Content)
+	}
+	if err != nil || fmt.Sprint(contents) != fmt.Sprint([]string{"log 0", "late", "later"}) {
+		t.Errorf("Read %q from cold storage - %v", contents, err)
+	}
+}
+
+// Test purging logs matching a query
+func TestPurge(t *testing.T) {
+	// more than a batch of matching logs, restored rather than written a log at a time
+	now := time.Now().UnixNano()
+	logs := &bytes.Buffer{}
+	for i := int64(0); i < 2500; i++ {
+		content := "nothing to see"
+		if i%2 == 0 {
+			content = "password=hunter2"
+		}
+		fmt.Fprintf(logs, `{"time":"%s","utime":%d,"id":"purger","tag":["purge"],"type":"purged","priority":2,"message":"%s"}`+"\n",
+			time.Unix(0, now+i).Format(time.RFC3339Nano), now+i, content)
+	}
+	if _, err := drain.Restore(logs); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	query := drain.Query{Type: "purged", Id: []string{"purger"}, Content: "hunter2"}
+
+	// dry runs only count
+	record, err := drain.Purge(query, drain.PurgeRecord{DryRun: true, By: "tester"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if record.Deleted != 1250 || record.Types["purged"] == nil || record.Types["purged"].Oldest != now || record.Types["purged"].Newest != now+2498 {
+		t.Errorf("%+v doesn't match expected out", record)
+	}
+	if msgs, _ := drain.Archiver.Slice(drain.Query{Type: "purged", Limit: 3000}); len(msgs) != 2500 {
+		t.Errorf("Dry run removed logs, %d left", len(msgs))
+	}
+
+	// held logs are kept
+	hold, err := drain.PlaceHold(drain.Hold{Type: "purged", Ids: []string{"purger"}, From: now, To: now, Reason: "evidence"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	record, err = drain.Purge(query, drain.PurgeRecord{By: "tester", Request: "q=REDACTED"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if record.Deleted != 1249 || record.Held != 1 || record.Types["purged"].Count != 1249 || record.Types["purged"].Oldest != now+2 {
+		t.Errorf("%+v doesn't match expected out", record)
+	}
+	if err = drain.ReleaseHold(hold.Id); err != nil {
+		t.Error(err)
+	}
+	if record, _ = drain.Purge(query, drain.PurgeRecord{By: "tester", Request: "q=REDACTED"}); record.Deleted != 1 {
+		t.Errorf("%+v doesn't match expected out", record)
+	}
+
+	msgs, err := drain.Archiver.Slice(drain.Query{Type: "purged", Limit: 3000})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msgs) != 1250 || msgs[0].Content != "nothing to see" {
+		t.Errorf("Expected 1250 logs left, got %d", len(msgs))
+	}
+	// the index no longer refers to the purged logs
+	msgs, _ = drain.Archiver.Slice(drain.Query{Type: "purged", Id: []string{"purger"}, Content: "hunter2", Limit: 10})
+	if len(msgs) != 0 {
+		t.Errorf("%+v doesn't match expected out", msgs)
+	}
+
+	// only the purge is audited, not the dry run
+	records, err := drain.Purges()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(records) != 2 || records[1].By != "tester" || records[1].Request != "q=REDACTED" || records[1].Deleted != 1249 {
+		t.Errorf("%+v doesn't match expected out", records)
+	}
+
+	// audit records aren't logs
+	stats, _ := drain.Stats(0)
+	if _, ok := stats.Types["_audit"]; ok {
+		t.Error("Purge records listed as a type of log")
+	}
+}
+
+// test opening an archive in use by another logvac
+func TestOpenInUse(t *testing.T) {
+	timeout := *drain.OpenTimeout
+	*drain.OpenTimeout = 100 * time.Millisecond
+	defer func() { *drain.OpenTimeout = timeout }()
+
+	// the test archive holds the db
+	archive, err := drain.NewBoltArchive("/tmp/boltdbTest/logvac.bolt")
+	if err == nil {
+		archive.Close()
+		t.Error("Opened an archive in use")
+	} else if !strings.Contains(err.Error(), "in use") {
+		t.Errorf("Expected the archive to be in use, got %s", err)
+	}
+}
+
+// Test log-keep is validated on start
+func TestBadLogKeep(t *testing.T) {
+	logKeep := config.LogKeep
+	defer func() { config.LogKeep = logKeep }()
+
+	for _, keep := range []string{
+		`{"app":"2w"`,
+		`{"app":"2x"}`,
+		`{"app":-1}`,
+		`{"app":{"max_size":"5GB"}}`,
+		`{"app":{"max_bytes":"5PB"}}`,
+		`{"app":{"levels":{"loud":"1d"}}}`,
+		`{"app":{"levels":{"error":"10"}}}`,
+	} {
+		config.LogKeep = keep
+		archive, err := drain.NewBoltArchive("/tmp/boltdbTest/keep.bolt")
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if err = archive.Init(); err == nil {
+			t.Errorf("%s is too forgiving", keep)
+		}
+		archive.Close()
+	}
+}
+
 func TestExpire(t *testing.T) {
-	go drain.Archiver.Expire()
-	time.Sleep(2 * time.Second)
+	hour := int64(time.Hour)
+	now := time.Now().UnixNano()
+	messages := []logvac.Message{
+		// kept an hour, errors a day
+		{Type: "leveled", Priority: 4, UTime: now - 2*24*hour, Content: "old error"},
+		{Type: "leveled", Priority: 2, UTime: now - 2*hour, Content: "info"},
+		{Type: "leveled", Priority: 4, UTime: now - 2*hour, Content: "error"},
+		{Type: "leveled", Priority: 2, UTime: now, Content: "new info"},
+		// newest 2 kept
+		{Type: "sized", UTime: now - 3, Content: "one"},
+		{Type: "sized", UTime: now - 2, Content: "two"},
+		{Type: "sized", UTime: now - 1, Content: "three"},
+		// kept a day (by default)
+		{Type: "defaulted", UTime: now - 2*24*hour, Content: "old"},
+		{Type: "defaulted", UTime: now, Content: "new"},
+		// held beyond their retention
+		{Type: "held", Id: "incident", UTime: now - 3*24*hour, Content: "hold expired"},
+		{Type: "held", Id: "incident", UTime: now - 2*24*hour, Content: "held"},
+		{Type: "held", Id: "bystander", UTime: now - 2*24*hour + 1, Content: "not held"},
+	}
+	holds := []drain.Hold{
+		{Type: "held", Ids: []string{"incident"}, From: now - 2*24*hour - hour, To: now - 2*24*hour + hour, Reason: "incident"},
+		{Type: "held", From: now - 4*24*hour, Reason: "expired", Expires: time.Now().Add(-time.Minute)},
+		{Type: "held,sized", From: now - 4*24*hour, Reason: "released"},
+		{Type: "sized", From: now - 3, To: now - 3, Reason: "counted"},
+	}
+	for i := range holds {
+		if _, err := drain.PlaceHold(holds[i]); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	if _, err := drain.PlaceHold(drain.Hold{Type: "held", Reason: "backwards", From: now, To: now - 1}); err == nil {
+		t.Error("Placed a hold ending before it starts")
+	}
+	placed, err := drain.Holds()
+	if err != nil || len(placed) != len(holds) || placed[2].Reason != "released" {
+		t.Errorf("%+v doesn't match expected out - %v", placed, err)
+		t.FailNow()
+	}
+	if err = drain.ReleaseHold(placed[2].Id); err != nil {
+		t.Error(err)
+	}
+	if err = drain.ReleaseHold(placed[2].Id); err == nil {
+		t.Error("Released a hold twice")
+	}
+
+	// written after the holds are placed, since expiring already runs (see drain.Init)
+	for i := range messages {
+		messages[i].Time = time.Unix(0, messages[i].UTime)
+		drain.Archiver.Write(messages[i])
+	}
+
+	drain.Archiver.(*drain.BoltArchive).ExpireNow()
 
 	// finish expire loop
 	drain.Archiver.(*drain.BoltArchive).Done <- true
 
 	// test successful clean
-	appMsgs, err := drain.Archiver.Slice("app", "", []string{""}, 0, 0, 100, 0)
+	appMsgs, err := drain.Archiver.Slice(drain.Query{Type: "app", Tag: []string{""}, Limit: 100})
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
 	}
 	// compare written message to original
 	if len(appMsgs) != 0 {
-		t.Errorf("%q doesn't match expected out", appMsgs)
+		t.Errorf("%+v doesn't match expected out", appMsgs)
 		t.FailNow()
 	}
 
 	// test successful clean
-	depMsgs, err := drain.Archiver.Slice("deploy", "", []string{""}, 0, 0, 100, 0)
+	depMsgs, err := drain.Archiver.Slice(drain.Query{Type: "deploy", Tag: []string{""}, Limit: 100})
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
 	}
 	// compare written message to original
 	if len(depMsgs) != 0 {
-		t.Errorf("%q doesn't match expected out", depMsgs)
+		t.Errorf("%+v doesn't match expected out", depMsgs)
 		t.FailNow()
 	}
 
+	// test expired partitions are removed
+	files, err := filepath.Glob("/tmp/boltdbTest/logvac.partitions/parted/*.bolt")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	// (yesterday's partition may still hold logs from the last hour)
+	if len(files) == 0 || len(files) > 2 {
+		t.Errorf("Expected expired partitions to be removed, got %q", files)
+	}
+	partMsgs, err := drain.Archiver.Slice(drain.Query{Type: "parted", Limit: 100})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(partMsgs) != 1 || partMsgs[0].Content != "day 3" {
+		t.Errorf("%+v doesn't match expected out", partMsgs)
+	}
+
+	// test combined rules
+	for kind, expected := range map[string][]string{
+		"leveled":   {"error", "new info"},
+		"sized":     {"one", "two", "three"},
+		"defaulted": {"new"},
+		"held":      {"held"},
+	} {
+		msgs, err := drain.Archiver.Slice(drain.Query{Type: kind, Limit: 100})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if len(msgs) != len(expected) {
+			t.Errorf("%+v doesn't match expected out", msgs)
+			continue
+		}
+		for i := range msgs {
+			if msgs[i].Content != expected[i] {
+				t.Errorf("%+v doesn't match expected out", msgs)
+				break
+			}
+		}
+	}
+
+	// test expiring is described
+	stats, err := drain.Stats(10)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if stats.Expire.Last.IsZero() || stats.Expire.Total == 0 {
+		t.Errorf("%+v doesn't match expected out", stats.Expire)
+	}
+
 	drain.Archiver.(*drain.BoltArchive).Close()
 
 }
@@ -113,7 +1295,8 @@ func initialize() error {
 	var err error
 	config.CleanFreq = 1
 	config.LogKeep = `{"app": "1s", "deploy":0}`
-	config.LogKeep = `{"app": "1s", "deploy":0, "a":"1m", "aa":"1h", "b":"1d", "c":"1w", "d":"1y", "e":"1"}`
+	config.LogKeep = `{"app": "1s", "deploy":0, "parted":"1h", "a":"1m", "aa":"1h", "b":"1d", "c":"1w", "d":"1y", "e":"1",
+		"leveled": {"max_age":"1h", "levels":{"error":"1d"}}, "sized": {"max_count":"2", "max_bytes":"1MB"}, "*":"1d"}`
 	config.Log = lumber.NewConsoleLogger(lumber.LvlInt("ERROR"))
 
 	// initialize logvac
@@ -0,0 +1,159 @@
+package drain
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/nanopack/logvac/core"
+)
+
+// dumpLineMax is the largest log (bytes) a dump may hold
+const dumpLineMax = 64 << 20
+
+// Dump writes the logs matching the query (oldest first) to w as newline
+// delimited json, gzipped if compress is set, returning the number of logs
+// written. A limit of 0 dumps every matching log.
+func (a *BoltArchive) Dump(w io.Writer, query Query, compress bool) (int64, error) {
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	buf := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buf)
+
+	query.Forward = true
+	if query.Limit == 0 {
+		query.Limit = math.MaxInt64
+	}
+
+	var dumped int64
+	err := a.Walk(query, func(msg logvac.Message) error {
+		if err := encoder.Encode(msg); err != nil {
+			return err
+		}
+		dumped++
+		return nil
+	})
+	if err != nil {
+		return dumped, fmt.Errorf("Failed to dump logs - %s", err)
+	}
+
+	if err = buf.Flush(); err != nil {
+		return dumped, fmt.Errorf("Failed to write dump - %s", err)
+	}
+	if gz != nil {
+		if err = gz.Close(); err != nil {
+			return dumped, fmt.Errorf("Failed to write dump - %s", err)
+		}
+	}
+
+	return dumped, nil
+}
+
+// Restore writes the logs of a dump (gzipped or not) to the archive under
+// their original keys, returning the number of logs restored. Logs in the
+// old message format are converted.
+func (a *BoltArchive) Restore(r io.Reader) (int64, error) {
+	reader := bufio.NewReader(r)
+	if magic, _ := reader.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to read dump - %s", err)
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = reader
+	}
+
+	var restored int64
+	batch := make([]logvac.Message, 0, walkBatch)
+	flush := func() error {
+		if err := a.writeAll(batch); err != nil {
+			return fmt.Errorf("Failed to restore logs - %s", err)
+		}
+		restored += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), dumpLineMax)
+	for line := 1; scanner.Scan(); line++ {
+		v := bytes.TrimSpace(scanner.Bytes())
+		if len(v) == 0 {
+			continue
+		}
+		msg, err := decode(v)
+		if err != nil {
+			return restored, fmt.Errorf("Bad log on line %d - %s", line, err)
+		}
+		if msg.Type == "" || msg.UTime == 0 {
+			return restored, fmt.Errorf("Bad log on line %d - missing type or utime", line)
+		}
+
+		batch = append(batch, msg)
+		if len(batch) == walkBatch {
+			if err = flush(); err != nil {
+				return restored, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return restored, fmt.Errorf("Failed to read dump - %s", err)
+	}
+
+	return restored, flush()
+}
+
+// writeAll stores messages a transaction per db, rather than a log at a time
+func (a *BoltArchive) writeAll(msgs []logvac.Message) error {
+	// keep the db from being swapped out while writing (see Compact)
+	a.wTex.RLock()
+	defer a.wTex.RUnlock()
+
+	dbs := make(map[*bolt.DB][]logvac.Message)
+	for _, msg := range msgs {
+		// don't archive raw stream
+		msg.Raw = []byte{}
+		db, err := a.partition(msg.Type, msg.UTime)
+		if err != nil {
+			return err
+		}
+		dbs[db] = append(dbs[db], msg)
+	}
+
+	kinds := make(map[string]bool)
+	for db, group := range dbs {
+		err := db.Update(func(tx *bolt.Tx) error {
+			for i := range group {
+				if err := store(tx, group[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i := range group {
+			a.track(db, group[i])
+			kinds[group[i].Type] = true
+		}
+	}
+
+	for kind := range kinds {
+		a.wake(kind)
+	}
+
+	return nil
+}
@@ -0,0 +1,203 @@
+package drain
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/nanopack/logvac/config"
+	"github.com/nanopack/logvac/core"
+)
+
+// holdBucket is the bucket (in the main db) holding the legal holds
+const holdBucket = "_holds"
+
+type (
+	// Hold keeps logs from being expired or purged, eg. to preserve the logs
+	// around an incident beyond their usual retention
+	Hold struct {
+		Id      string    `json:"id"`      // assigned when the hold is placed
+		Type    string    `json:"type"`    // type(s) of logs held ("app", "app,deploy", or "*")
+		Ids     []string  `json:"ids"`     // only hold logs from these ids (every id if empty)
+		Tags    []string  `json:"tags"`    // only hold logs with one of these tags (every tag if empty)
+		From    int64     `json:"from"`    // utime of the oldest log held (0 holds every older log)
+		To      int64     `json:"to"`      // utime of the newest log held (0 holds logs as they're written)
+		Reason  string    `json:"reason"`  // why the logs are held
+		Expires time.Time `json:"expires"` // when the hold is released (zero holds until released)
+		Placed  time.Time `json:"placed"`  // when the hold was placed
+		By      string    `json:"by"`      // who placed the hold
+	}
+
+	// holds are the holds on a type of logs
+	holds []Hold
+)
+
+// covers returns true if a log written at utime is in the hold's time range
+func (h Hold) covers(utime int64) bool {
+	return utime >= h.From && (h.To == 0 || utime <= h.To)
+}
+
+// active returns true until the hold expires
+func (h Hold) active(now time.Time) bool {
+	return h.Expires.IsZero() || now.Before(h.Expires)
+}
+
+// keeps returns true if the log (key and value) is held
+func (held holds) keeps(k, v []byte) bool {
+	t := utime(k)
+	for i := range held {
+		if !held[i].covers(t) {
+			continue
+		}
+		if len(held[i].Ids) == 0 && len(held[i].Tags) == 0 {
+			return true
+		}
+		msg, err := decodeHeader(v, false)
+		if err != nil {
+			// keep what can't be checked
+			return true
+		}
+		if (Query{Id: held[i].Ids, Tag: held[i].Tags}).Match(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepsLog returns true if the (decoded) log is held
+func (held holds) keepsLog(msg logvac.Message) bool {
+	for i := range held {
+		if held[i].covers(msg.UTime) && (Query{Id: held[i].Ids, Tag: held[i].Tags}).Match(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlaps returns true if logs written between from and to (exclusive) may be
+// held
+func (held holds) overlaps(from, to int64) bool {
+	for i := range held {
+		if held[i].From < to && (held[i].To == 0 || held[i].To >= from) {
+			return true
+		}
+	}
+	return false
+}
+
+// PlaceHold stores a hold, returning it as placed. Logs are held once it
+// returns (expiring or purging in progress is waited for).
+func (a *BoltArchive) PlaceHold(hold Hold) (*Hold, error) {
+	if hold.Type == "" {
+		return nil, fmt.Errorf("Bad hold - missing type")
+	}
+	if hold.Reason == "" {
+		return nil, fmt.Errorf("Bad hold - missing reason")
+	}
+	if hold.To != 0 && hold.To < hold.From {
+		return nil, fmt.Errorf("Bad hold - 'to' is before 'from'")
+	}
+
+	// don't place holds mid expire or purge
+	a.maint.Lock()
+	defer a.maint.Unlock()
+
+	hold.Placed = time.Now().UTC()
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(holdBucket))
+		if err != nil {
+			return err
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		hold.Id = strconv.FormatUint(seq, 10)
+
+		value, err := json.Marshal(hold)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(utimeKey(int64(seq)), value)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to place hold - %s", err)
+	}
+
+	config.Log.Info("Placed hold %s on '%s' logs (%s) for %s", hold.Id, hold.Type, hold.Reason, hold.By)
+	return &hold, nil
+}
+
+// Holds returns every hold placed (oldest first), expired or not
+func (a *BoltArchive) Holds() ([]Hold, error) {
+	placed := make([]Hold, 0)
+	// keep the main db from being swapped out while reading (see Compact)
+	a.wTex.RLock()
+	defer a.wTex.RUnlock()
+	err := a.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(holdBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			hold := Hold{}
+			if err := json.Unmarshal(v, &hold); err != nil {
+				return fmt.Errorf("Bad hold - %s", err)
+			}
+			placed = append(placed, hold)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read holds - %s", err)
+	}
+
+	return placed, nil
+}
+
+// ReleaseHold removes a hold, once expiring or purging in progress is done
+func (a *BoltArchive) ReleaseHold(id string) error {
+	seq, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return fmt.Errorf("No hold '%s'", id)
+	}
+
+	// compacting would bring the hold back, and expiring or purging in progress
+	// still keeps its logs
+	a.maint.Lock()
+	defer a.maint.Unlock()
+
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(holdBucket))
+		if bucket == nil || bucket.Get(utimeKey(int64(seq))) == nil {
+			return fmt.Errorf("No hold '%s'", id)
+		}
+		return bucket.Delete(utimeKey(int64(seq)))
+	})
+	if err != nil {
+		return err
+	}
+
+	config.Log.Info("Released hold %s", id)
+	return nil
+}
+
+// held returns the active holds on a type of logs
+func (a *BoltArchive) held(kind string) (holds, error) {
+	placed, err := a.Holds()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var held holds
+	for i := range placed {
+		if placed[i].active(now) && matchType(placed[i].Type, kind) {
+			held = append(held, placed[i])
+		}
+	}
+	return held, nil
+}
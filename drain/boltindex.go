@@ -0,0 +1,390 @@
+package drain
+
+import (
+	"bytes"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/nanopack/logvac/config"
+	"github.com/nanopack/logvac/core"
+)
+
+// indexes are stored as `_index/<type>/<id|tag>/<value>/<record key>` so logs
+// from a quiet id (or with a rare tag) can be found without unmarshalling every
+// log of the type
+const (
+	indexBucket = "_index"
+	indexDone   = "complete" // set once all of a type's logs have been indexed
+	indexMark   = "progress" // key of the last log indexed while building
+	indexBatch  = 10000      // logs indexed per transaction while building
+)
+
+type (
+	// recordCursor walks the logs of a type
+	recordCursor interface {
+		// seek moves to the newest log at or before key
+		seek(key []byte) ([]byte, []byte)
+		// prev moves to the next older log
+		prev() ([]byte, []byte)
+		// after moves to the oldest log at or after key
+		after(key []byte) ([]byte, []byte)
+		// next moves to the next newer log
+		next() ([]byte, []byte)
+	}
+
+	// bucketCursor walks all the logs in a type's bucket
+	bucketCursor struct {
+		c *bolt.Cursor
+	}
+
+	// indexCursor walks the logs listed in one or more indexes
+	indexCursor struct {
+		records *bolt.Bucket
+		cursors []*bolt.Cursor
+		keys    [][]byte
+		forward bool // walking towards newer logs
+	}
+)
+
+func (b bucketCursor) seek(key []byte) ([]byte, []byte) {
+	k, v := b.c.Seek(key)
+
+	// if the record's utime (k) doesn't match the specified "initial" value, use previous record.
+	// note: https://github.com/boltdb/bolt/blob/v1.2.0/cursor.go#L114 explains why.
+	if !bytes.Equal(k, key) {
+		k, v = b.c.Prev()
+	}
+	return k, v
+}
+
+func (b bucketCursor) prev() ([]byte, []byte) {
+	return b.c.Prev()
+}
+
+func (b bucketCursor) after(key []byte) ([]byte, []byte) {
+	return b.c.Seek(key)
+}
+
+func (b bucketCursor) next() ([]byte, []byte) {
+	return b.c.Next()
+}
+
+func (ic *indexCursor) seek(key []byte) ([]byte, []byte) {
+	ic.forward = false
+	ic.keys = make([][]byte, len(ic.cursors))
+	for i, c := range ic.cursors {
+		k, _ := c.Seek(key)
+		if !bytes.Equal(k, key) {
+			k, _ = c.Prev()
+		}
+		ic.keys[i] = k
+	}
+	return ic.current()
+}
+
+func (ic *indexCursor) after(key []byte) ([]byte, []byte) {
+	ic.forward = true
+	ic.keys = make([][]byte, len(ic.cursors))
+	for i, c := range ic.cursors {
+		ic.keys[i], _ = c.Seek(key)
+	}
+	return ic.current()
+}
+
+func (ic *indexCursor) prev() ([]byte, []byte) {
+	ic.advance(ic.nearest())
+	return ic.current()
+}
+
+func (ic *indexCursor) next() ([]byte, []byte) {
+	ic.advance(ic.nearest())
+	return ic.current()
+}
+
+// advance moves every index listing the log at key past it (a log can have many tags)
+func (ic *indexCursor) advance(key []byte) {
+	for i, c := range ic.cursors {
+		if ic.keys[i] != nil && bytes.Equal(ic.keys[i], key) {
+			if ic.forward {
+				ic.keys[i], _ = c.Next()
+			} else {
+				ic.keys[i], _ = c.Prev()
+			}
+		}
+	}
+}
+
+// current returns the next log the indexes point to
+func (ic *indexCursor) current() ([]byte, []byte) {
+	for {
+		k := ic.nearest()
+		if k == nil {
+			return nil, nil
+		}
+		v := ic.records.Get(k)
+		if v != nil {
+			return k, v
+		}
+		// skip index entries of expired logs
+		ic.advance(k)
+	}
+}
+
+// nearest returns the key the index cursors are at that is next in the walk's
+// direction (the largest key walking backwards, the smallest walking forward)
+func (ic *indexCursor) nearest() []byte {
+	var nearest []byte
+	for _, k := range ic.keys {
+		if k == nil {
+			continue
+		}
+		if nearest == nil || (ic.forward && bytes.Compare(k, nearest) < 0) || (!ic.forward && bytes.Compare(k, nearest) > 0) {
+			nearest = k
+		}
+	}
+	return nearest
+}
+
+// cursor returns the cheapest way to walk the logs matching the query. Indexes
+// are used for exact ids or exact tags, once the type is fully indexed.
+func cursor(tx *bolt.Tx, records *bolt.Bucket, query Query) recordCursor {
+	all := bucketCursor{records.Cursor()}
+
+	idx := typeIndex(tx, query.Type)
+	if idx == nil || idx.Get([]byte(indexDone)) == nil {
+		return all
+	}
+
+	// exclusions and patterns are left to Query.Match
+	field, values := "id", []string(nil)
+	if ids, ok := exact(query.Id); ok {
+		values = ids
+	} else if tags, ok := exact(query.Tag); ok {
+		field, values = "tag", tags
+	} else {
+		return all
+	}
+
+	ic := &indexCursor{records: records}
+	for _, value := range values {
+		if b := indexOf(idx, field, value); b != nil {
+			ic.cursors = append(ic.cursors, b.Cursor())
+		}
+	}
+
+	return ic
+}
+
+// typeIndex returns the index bucket of a type
+func typeIndex(tx *bolt.Tx, kind string) *bolt.Bucket {
+	root := tx.Bucket([]byte(indexBucket))
+	if root == nil {
+		return nil
+	}
+	return root.Bucket([]byte(kind))
+}
+
+// indexOf returns the bucket listing the logs with the given id or tag
+func indexOf(idx *bolt.Bucket, field, value string) *bolt.Bucket {
+	b := idx.Bucket([]byte(field))
+	if b == nil {
+		return nil
+	}
+	return b.Bucket([]byte(value))
+}
+
+// index adds a log's key to the indexes of its id and tags
+func index(tx *bolt.Tx, msg logvac.Message, key []byte) error {
+	root, err := tx.CreateBucketIfNotExists([]byte(indexBucket))
+	if err != nil {
+		return err
+	}
+	idx, err := root.CreateBucketIfNotExists([]byte(msg.Type))
+	if err != nil {
+		return err
+	}
+
+	if msg.Id != "" {
+		if err = addIndex(idx, "id", msg.Id, key); err != nil {
+			return err
+		}
+	}
+	for _, tag := range msg.Tag {
+		if tag == "" {
+			continue
+		}
+		if err = addIndex(idx, "tag", tag, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addIndex(idx *bolt.Bucket, field, value string, key []byte) error {
+	b, err := idx.CreateBucketIfNotExists([]byte(field))
+	if err != nil {
+		return err
+	}
+	b, err = b.CreateBucketIfNotExists([]byte(value))
+	if err != nil {
+		return err
+	}
+	return b.Put(key, []byte{})
+}
+
+// unindex removes a log's key from the indexes of its id and tags
+func unindex(tx *bolt.Tx, kind string, msg logvac.Message, key []byte) error {
+	idx := typeIndex(tx, kind)
+	if idx == nil {
+		return nil
+	}
+
+	values := map[string][]string{"id": {msg.Id}, "tag": msg.Tag}
+	for field := range values {
+		for _, value := range values[field] {
+			if b := indexOf(idx, field, value); b != nil {
+				if err := b.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// pruneIndex removes index entries of logs older than cutoff (nil removes all)
+func pruneIndex(tx *bolt.Tx, kind string, cutoff []byte) error {
+	root := tx.Bucket([]byte(indexBucket))
+	if root == nil {
+		return nil
+	}
+	idx := root.Bucket([]byte(kind))
+	if idx == nil {
+		return nil
+	}
+	if cutoff == nil {
+		return root.DeleteBucket([]byte(kind))
+	}
+
+	for _, field := range []string{"id", "tag"} {
+		fb := idx.Bucket([]byte(field))
+		if fb == nil {
+			continue
+		}
+
+		// gather values first, buckets can't be deleted while iterating
+		var values [][]byte
+		fb.ForEach(func(k, v []byte) error {
+			if v == nil {
+				values = append(values, append([]byte{}, k...))
+			}
+			return nil
+		})
+
+		for _, value := range values {
+			b := fb.Bucket(value)
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, cutoff) < 0; k, _ = c.First() {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			if k, _ := c.First(); k == nil {
+				if err := fb.DeleteBucket(value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// buildIndexes indexes logs archived before indexing existed. Progress is saved
+// so building resumes after a restart; until a type is fully indexed, fetching
+// its logs falls back to scanning.
+func (a *BoltArchive) buildIndexes() {
+	var kinds []string
+	a.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if reserved(string(name)) {
+				return nil
+			}
+			idx := typeIndex(tx, string(name))
+			if idx == nil || idx.Get([]byte(indexDone)) == nil {
+				kinds = append(kinds, string(name))
+			}
+			return nil
+		})
+	})
+
+	for _, kind := range kinds {
+		config.Log.Info("Indexing '%s' logs...", kind)
+		for done := false; !done; {
+			// don't index while compacting
+			a.maint.Lock()
+			err := a.db.Update(func(tx *bolt.Tx) error {
+				var err error
+				done, err = indexSome(tx, kind)
+				return err
+			})
+			a.maint.Unlock()
+			if err != nil {
+				config.Log.Error("Failed to index '%s' logs - %s", kind, err)
+				break
+			}
+		}
+		config.Log.Info("Done indexing '%s' logs", kind)
+	}
+}
+
+// indexSome indexes the next batch of a type's logs, returning true once all
+// have been indexed
+func indexSome(tx *bolt.Tx, kind string) (bool, error) {
+	records := tx.Bucket([]byte(kind))
+	if records == nil {
+		return true, nil
+	}
+
+	root, err := tx.CreateBucketIfNotExists([]byte(indexBucket))
+	if err != nil {
+		return false, err
+	}
+	idx, err := root.CreateBucketIfNotExists([]byte(kind))
+	if err != nil {
+		return false, err
+	}
+
+	c := records.Cursor()
+	k, v := c.First()
+	if mark := idx.Get([]byte(indexMark)); mark != nil {
+		k, v = c.Seek(mark)
+		if bytes.Equal(k, mark) {
+			k, v = c.Next()
+		}
+	}
+
+	for i := 0; k != nil && i < indexBatch; k, v = c.Next() {
+		i++
+		msg, err := decode(v)
+		if err != nil {
+			config.Log.Debug("Skipping unreadable log while indexing - %s", err)
+			continue
+		}
+		msg.Type = kind
+		if err = index(tx, msg, k); err != nil {
+			return false, err
+		}
+		if err = idx.Put([]byte(indexMark), k); err != nil {
+			return false, err
+		}
+	}
+
+	if k != nil {
+		return false, nil
+	}
+
+	return true, idx.Put([]byte(indexDone), []byte("true"))
+}
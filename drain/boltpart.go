@@ -0,0 +1,303 @@
+package drain
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/nanopack/logvac/config"
+)
+
+// partitions are stored as `<db-address>.partitions/<type>/<start>-<end>.bolt`
+// so expired logs can be removed (and their space reclaimed) a file at a time
+
+type (
+	// partition is a bolt file holding the logs of a type for a period of time
+	partition struct {
+		start int64 // utime of the oldest log the partition holds
+		end   int64 // utime of the first log the partition doesn't hold
+		path  string
+		db    *bolt.DB
+	}
+)
+
+// ParsePeriod converts a period such as "1d" to nanoseconds
+func ParsePeriod(period string) (int64, error) {
+	match := regexp.MustCompile("^([0-9]+)([smhdwy])$").FindStringSubmatch(period)
+	if len(match) != 3 {
+		return 0, fmt.Errorf("Bad period '%s' (X(s)ec, (m)in, (h)our, (d)ay, (w)eek, (y)ear)", period)
+	}
+	number, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil || number < 1 {
+		return 0, fmt.Errorf("Bad period '%s' - must be greater than 0", period)
+	}
+
+	unit := map[string]int64{
+		"s": 1000000000,
+		"m": 60000000000,
+		"h": 3600000000000,
+		"d": 86400000000000,
+		"w": 604800000000000,
+		"y": 31449600000000000, // 52 weeks
+	}[match[2]]
+
+	return number * unit, nil
+}
+
+// partDir returns the directory partitions are stored in
+func (a *BoltArchive) partDir() string {
+	return partDir(a.path)
+}
+
+// partDir returns the directory the partitions of the main db at path are
+// stored in
+func partDir(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".partitions"
+}
+
+// escapeType makes a type safe to use as a directory name
+func escapeType(kind string) string {
+	return strings.Replace(url.PathEscape(kind), ".", "%2E", -1)
+}
+
+// openPartitions configures partitioning and opens the partitions of previous
+// runs. Partitions are opened even if partitioning has since been disabled, so
+// their logs can still be fetched and expired.
+func (a *BoltArchive) openPartitions() error {
+	a.period = 0
+	if config.Partition != "" {
+		period, err := ParsePeriod(config.Partition)
+		if err != nil {
+			return fmt.Errorf("Failed to configure partitions - %s", err)
+		}
+		a.period = period
+	}
+
+	dirs, err := ioutil.ReadDir(a.partDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Failed to read partitions - %s", err)
+	}
+
+	a.pTex.Lock()
+	defer a.pTex.Unlock()
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		kind, err := url.PathUnescape(dir.Name())
+		if err != nil {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(a.partDir(), dir.Name()))
+		if err != nil {
+			return fmt.Errorf("Failed to read partitions - %s", err)
+		}
+		for _, file := range files {
+			p := &partition{path: filepath.Join(a.partDir(), dir.Name(), file.Name())}
+			if _, err := fmt.Sscanf(file.Name(), "%d-%d.bolt", &p.start, &p.end); err != nil {
+				continue
+			}
+			p.db, err = bolt.Open(p.path, 0644, &bolt.Options{Timeout: openTimeout})
+			if err != nil {
+				return fmt.Errorf("Failed to open partition '%s' - %s", p.path, err)
+			}
+			a.parts[kind] = append(a.parts[kind], p)
+		}
+
+		sort.Slice(a.parts[kind], func(i, j int) bool {
+			return a.parts[kind][i].start < a.parts[kind][j].start
+		})
+	}
+
+	return nil
+}
+
+// partition returns the db to write a log of the given type and utime to,
+// creating its partition if needed
+func (a *BoltArchive) partition(kind string, utime int64) (*bolt.DB, error) {
+	if a.period == 0 || kind == "" {
+		return a.db, nil
+	}
+
+	a.pTex.RLock()
+	p := find(a.parts[kind], utime)
+	a.pTex.RUnlock()
+	if p != nil {
+		return p.db, nil
+	}
+
+	a.pTex.Lock()
+	defer a.pTex.Unlock()
+
+	parts := a.parts[kind]
+	if p = find(parts, utime); p != nil {
+		return p.db, nil
+	}
+
+	p = &partition{start: utime - utime%a.period}
+	if utime%a.period < 0 {
+		p.start -= a.period
+	}
+	p.end = p.start + a.period
+
+	// don't overlap the partitions of a previous period
+	i := sort.Search(len(parts), func(i int) bool { return parts[i].start > utime })
+	if i > 0 && parts[i-1].end > p.start {
+		p.start = parts[i-1].end
+	}
+	if i < len(parts) && parts[i].start < p.end {
+		p.end = parts[i].start
+	}
+
+	dir := filepath.Join(a.partDir(), escapeType(kind))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create partition - %s", err)
+	}
+	p.path = filepath.Join(dir, fmt.Sprintf("%d-%d.bolt", p.start, p.end))
+
+	var err error
+	p.db, err = bolt.Open(p.path, 0644, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create partition - %s", err)
+	}
+	config.Log.Debug("Created partition '%s'", p.path)
+
+	parts = append(parts, nil)
+	copy(parts[i+1:], parts[i:])
+	parts[i] = p
+	a.parts[kind] = parts
+
+	return p.db, nil
+}
+
+// find returns the partition holding utime, if any
+func find(parts []*partition, utime int64) *partition {
+	// most logs are recent, search newest first
+	for i := len(parts) - 1; i >= 0; i-- {
+		if parts[i].start <= utime && utime < parts[i].end {
+			return parts[i]
+		}
+	}
+	return nil
+}
+
+// partitions returns the partitions that may hold logs of the given type
+// between start (0 is newest) and end, newest first (by the newest log each may
+// hold). The main db holds logs archived before partitioning, or since it was
+// turned off, so it's placed by the range of logs it actually holds.
+func (a *BoltArchive) partitions(kind string, start, end int64) []*partition {
+	a.pTex.RLock()
+	parts := a.parts[kind]
+	found := make([]*partition, 0, len(parts)+1)
+	for i := len(parts) - 1; i >= 0; i-- {
+		if (start == 0 || parts[i].start <= start) && parts[i].end > end {
+			found = append(found, parts[i])
+		}
+	}
+	a.pTex.RUnlock()
+
+	main := &partition{path: a.path, db: a.db}
+	a.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(kind)); bucket != nil {
+			c := bucket.Cursor()
+			if first, _ := c.First(); first != nil {
+				last, _ := c.Last()
+				main.start, main.end = utime(first), utime(last)+1
+			}
+		}
+		return nil
+	})
+
+	// ahead of the partitions holding older logs than its newest
+	i := len(found)
+	for i > 0 && found[i-1].end < main.end {
+		i--
+	}
+	found = append(found, nil)
+	copy(found[i+1:], found[i:])
+	found[i] = main
+
+	return found
+}
+
+// dropPartitions removes the partitions of a type holding only logs older than
+// before (and none that may be held), returning the number of logs and
+// partitions removed
+func (a *BoltArchive) dropPartitions(kind string, before int64, held holds) (int64, int) {
+	a.pTex.RLock()
+	var expired []*partition
+	for _, p := range a.parts[kind] {
+		if p.end <= before && !held.overlaps(p.start, p.end) {
+			expired = append(expired, p)
+		}
+	}
+	a.pTex.RUnlock()
+
+	var deleted int64
+	for _, p := range expired {
+		deleted += a.dropPartition(kind, p)
+	}
+	return deleted, len(expired)
+}
+
+// dropPartition closes and deletes a partition, returning the number of logs
+// it held
+func (a *BoltArchive) dropPartition(kind string, p *partition) int64 {
+	a.pTex.Lock()
+	parts := a.parts[kind]
+	for i := range parts {
+		if parts[i] == p {
+			a.parts[kind] = append(parts[:i:i], parts[i+1:]...)
+			break
+		}
+	}
+	a.pTex.Unlock()
+
+	var logs int64
+	p.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(kind)); bucket != nil {
+			logs = int64(bucket.Stats().KeyN)
+		}
+		return nil
+	})
+
+	// waits for reads in progress to finish
+	if err := p.db.Close(); err != nil {
+		config.Log.Error("Failed to close partition '%s' - %s", p.path, err)
+		return 0
+	}
+	if err := os.Remove(p.path); err != nil {
+		config.Log.Error("Failed to remove partition '%s' - %s", p.path, err)
+		return 0
+	}
+	config.Log.Debug("Removed partition '%s'", p.path)
+	return logs
+}
+
+// closePartitions closes all partitions
+func (a *BoltArchive) closePartitions() {
+	a.pTex.Lock()
+	defer a.pTex.Unlock()
+
+	for kind, parts := range a.parts {
+		for _, p := range parts {
+			if err := p.db.Close(); err != nil {
+				config.Log.Error("Failed to close partition '%s' - %s", p.path, err)
+			}
+		}
+		delete(a.parts, kind)
+	}
+}
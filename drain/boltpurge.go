@@ -0,0 +1,232 @@
+package drain
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/nanopack/logvac/config"
+	"github.com/nanopack/logvac/core"
+)
+
+const (
+	auditBucket = "_audit" // bucket (in the main db) holding a record of each purge
+	purgeBatch  = 1000     // number of logs deleted per transaction when purging
+)
+
+type (
+	// PurgeRecord describes the logs a purge removed (or, for a dry run, would)
+	PurgeRecord struct {
+		Time    time.Time              `json:"time"`    // when the logs were purged
+		By      string                 `json:"by"`      // who purged them
+		Request string                 `json:"request"` // the filters purged by (content matches are redacted)
+		DryRun  bool                   `json:"dry_run"` // whether the logs were only counted
+		Deleted int64                  `json:"deleted"` // number of logs removed (or matched, for a dry run)
+		Held    int64                  `json:"held"`    // number of matching logs kept by holds
+		Cold    int64                  `json:"cold"`    // number of logs removed from cold storage (or matched, for a dry run)
+		Types   map[string]*PurgedType `json:"types"`   // logs removed of each type
+	}
+
+	// PurgedType describes the logs of a type a purge removed
+	PurgedType struct {
+		Count  int64 `json:"count"`  // number of logs
+		Oldest int64 `json:"oldest"` // utime of the oldest log
+		Newest int64 `json:"newest"` // utime of the newest log
+	}
+)
+
+// Purge deletes the logs matching the query (between its start and end, the
+// limit is ignored), a batch at a time, and from the objects in cold storage
+// holding any, and records what was deleted. Held logs are kept. A dry run only
+// counts the matching logs.
+func (a *BoltArchive) Purge(query Query, record PurgeRecord) (*PurgeRecord, error) {
+	// don't compact or expire while purging
+	a.maint.Lock()
+	defer a.maint.Unlock()
+
+	record.Time = time.Now().UTC()
+	record.Deleted = 0
+	record.Held = 0
+	record.Cold = 0
+	record.Types = make(map[string]*PurgedType)
+
+	query.Limit = math.MaxInt64
+	query.ScanLimit = 0
+	query.Forward = false
+	for _, kind := range a.types(query.Type) {
+		typed := query
+		typed.Type = kind
+		held, err := a.held(kind)
+		if err != nil {
+			return &record, fmt.Errorf("Failed to purge '%s' logs - %s", kind, err)
+		}
+		for _, p := range a.partitions(kind, query.Start, query.End) {
+			deleted, kept, err := a.purge(p.db, typed, held, record.DryRun, record.Types)
+			record.Deleted += deleted
+			record.Held += kept
+			if err != nil {
+				return &record, fmt.Errorf("Failed to purge '%s' logs - %s", kind, err)
+			}
+		}
+	}
+
+	// logs already offloaded are purged from cold storage too
+	if a.cold != nil {
+		for _, kind := range a.coldTypes() {
+			if !matchType(query.Type, kind) {
+				continue
+			}
+			typed := query
+			typed.Type = kind
+			held, err := a.held(kind)
+			if err != nil {
+				return &record, fmt.Errorf("Failed to purge cold '%s' logs - %s", kind, err)
+			}
+			deleted, err := a.purgeCold(typed, held, record.DryRun)
+			record.Cold += deleted
+			if err != nil {
+				return &record, fmt.Errorf("Failed to purge cold '%s' logs - %s", kind, err)
+			}
+		}
+	}
+
+	if record.DryRun {
+		return &record, nil
+	}
+
+	config.Log.Info("Purged %d logs and %d cold logs (%s) for %s", record.Deleted, record.Cold, record.Request, record.By)
+	if err := a.audit(record); err != nil {
+		return &record, fmt.Errorf("Failed to record purge - %s", err)
+	}
+
+	return &record, nil
+}
+
+// purge deletes the logs of a type in db matching the query (unless held),
+// newest first, a batch per transaction, counting them in purged. The number of
+// logs deleted and held is returned.
+func (a *BoltArchive) purge(db *bolt.DB, query Query, held holds, dryRun bool, purged map[string]*PurgedType) (int64, int64, error) {
+	var deleted, kept int64
+	for {
+		var keys [][]byte
+		var msgs []logvac.Message
+		err := scan(db, query, func(k, v []byte) (bool, error) {
+			msg, err := decode(v)
+			if err != nil {
+				return false, err
+			}
+			if query.Match(msg) {
+				if held.keeps(k, v) {
+					kept++
+				} else {
+					keys = append(keys, append([]byte{}, k...))
+					msgs = append(msgs, msg)
+				}
+			}
+			// continue from the last log scanned
+			query.Start = utime(k) - 1
+			return len(keys) < purgeBatch, nil
+		})
+		if err == bolt.ErrDatabaseNotOpen {
+			// partition expired while purging
+			return deleted, kept, nil
+		}
+		if err != nil {
+			return deleted, kept, err
+		}
+		if len(keys) == 0 {
+			return deleted, kept, nil
+		}
+
+		if !dryRun {
+			// keep the db from being swapped out while writing (see Compact)
+			a.wTex.RLock()
+			err = db.Update(func(tx *bolt.Tx) error {
+				bucket := tx.Bucket([]byte(query.Type))
+				if bucket == nil {
+					return nil
+				}
+				for i := range keys {
+					if err := bucket.Delete(keys[i]); err != nil {
+						return err
+					}
+					if err := unindex(tx, query.Type, msgs[i], keys[i]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			a.wTex.RUnlock()
+			if err != nil {
+				return deleted, kept, err
+			}
+		}
+
+		t, ok := purged[query.Type]
+		if !ok {
+			t = &PurgedType{Oldest: math.MaxInt64}
+			purged[query.Type] = t
+		}
+		for i := range msgs {
+			t.Count++
+			if msgs[i].UTime < t.Oldest {
+				t.Oldest = msgs[i].UTime
+			}
+			if msgs[i].UTime > t.Newest {
+				t.Newest = msgs[i].UTime
+			}
+		}
+		deleted += int64(len(keys))
+
+		// a short batch means there is nothing left to scan
+		if len(keys) < purgeBatch || query.Start <= 0 {
+			return deleted, kept, nil
+		}
+	}
+}
+
+// audit records a purge (maint must be held, see Compact)
+func (a *BoltArchive) audit(record PurgeRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return a.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(auditBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Put(utimeKey(record.Time.UnixNano()), value)
+	})
+}
+
+// Purges returns the record of each purge, newest first
+func (a *BoltArchive) Purges() ([]PurgeRecord, error) {
+	records := make([]PurgeRecord, 0)
+	// keep the main db from being swapped out while reading (see Compact)
+	a.wTex.RLock()
+	defer a.wTex.RUnlock()
+	err := a.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(auditBucket))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			record := PurgeRecord{}
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("Bad purge record - %s", err)
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read purges - %s", err)
+	}
+
+	return records, nil
+}
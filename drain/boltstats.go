@@ -0,0 +1,164 @@
+package drain
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+type (
+	// ArchiveStats describes what the archive holds
+	ArchiveStats struct {
+		Files  int                   `json:"files"`  // number of db files (the main db and every partition)
+		Bytes  int64                 `json:"bytes"`  // size (bytes) of the db files
+		Types  map[string]*TypeStats `json:"types"`  // logs of each type
+		Expire ExpireStats           `json:"expire"` // logs removed by expiring
+	}
+
+	// TypeStats describes the logs of a type the archive holds
+	TypeStats struct {
+		Count      int64     `json:"count"`      // number of logs
+		Oldest     int64     `json:"oldest"`     // utime of the oldest log
+		Newest     int64     `json:"newest"`     // utime of the newest log
+		Partitions int       `json:"partitions"` // number of partitions holding the logs
+		Bytes      int64     `json:"bytes"`      // size (bytes) of the partitions (logs in the main db aren't counted)
+		TopIds     []IdStats `json:"top_ids"`    // ids with the most logs
+	}
+
+	// IdStats is the number of logs from an id
+	IdStats struct {
+		Id    string `json:"id"`
+		Count int64  `json:"count"`
+	}
+
+	// ExpireStats describes the logs removed by expiring
+	ExpireStats struct {
+		Last       time.Time `json:"last"`       // when logs were last expired (zero if never)
+		Deleted    int64     `json:"deleted"`    // number of logs removed the last time
+		Partitions int       `json:"partitions"` // number of partitions removed the last time
+		Total      int64     `json:"total"`      // number of logs removed since starting
+	}
+)
+
+// Stats describes the types of logs the archive holds (with the `top` ids
+// logging the most of each), the size of its files, and what expiring removed
+func (a *BoltArchive) Stats(top int) (*ArchiveStats, error) {
+	a.wTex.RLock()
+	defer a.wTex.RUnlock()
+
+	stats := &ArchiveStats{Types: make(map[string]*TypeStats)}
+	ids := make(map[string]map[string]int64) // logs per id of each type
+
+	// the main db first, then each partition
+	dbs := []*partition{{path: a.path, db: a.db}}
+	a.pTex.RLock()
+	for _, parts := range a.parts {
+		dbs = append(dbs, parts...)
+	}
+	a.pTex.RUnlock()
+
+	for _, p := range dbs {
+		err := p.db.View(func(tx *bolt.Tx) error {
+			stats.Files++
+			stats.Bytes += tx.Size()
+
+			return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+				kind := string(name)
+				if reserved(kind) {
+					return nil
+				}
+
+				t, ok := stats.Types[kind]
+				if !ok {
+					t = &TypeStats{TopIds: []IdStats{}}
+					stats.Types[kind] = t
+					ids[kind] = make(map[string]int64)
+				}
+				if p.db != a.db {
+					t.Partitions++
+					t.Bytes += tx.Size()
+				}
+
+				c := bucket.Cursor()
+				first, _ := c.First()
+				last, _ := c.Last()
+				if first == nil {
+					return nil
+				}
+				t.Count += int64(bucket.Stats().KeyN)
+				if oldest := utime(first); t.Oldest == 0 || oldest < t.Oldest {
+					t.Oldest = oldest
+				}
+				if newest := utime(last); newest > t.Newest {
+					t.Newest = newest
+				}
+
+				return countIds(tx, kind, bucket, ids[kind])
+			})
+		})
+		if err == bolt.ErrDatabaseNotOpen {
+			// partition expired while reading
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read '%s' - %s", p.path, err)
+		}
+	}
+
+	for kind, counts := range ids {
+		for id, count := range counts {
+			if count == 0 {
+				continue
+			}
+			stats.Types[kind].TopIds = append(stats.Types[kind].TopIds, IdStats{id, count})
+		}
+		topIds := stats.Types[kind].TopIds
+		sort.Slice(topIds, func(i, j int) bool {
+			if topIds[i].Count == topIds[j].Count {
+				return topIds[i].Id < topIds[j].Id
+			}
+			return topIds[i].Count > topIds[j].Count
+		})
+		if len(topIds) > top {
+			stats.Types[kind].TopIds = topIds[:top]
+		}
+	}
+
+	a.sTex.Lock()
+	stats.Expire = a.expired
+	a.sTex.Unlock()
+
+	return stats, nil
+}
+
+// countIds adds the number of logs of each id in a type's bucket to counts,
+// using the index if it's complete (rather than decoding every log)
+func countIds(tx *bolt.Tx, kind string, bucket *bolt.Bucket, counts map[string]int64) error {
+	idx := typeIndex(tx, kind)
+	if idx != nil && idx.Get([]byte(indexDone)) != nil {
+		byId := idx.Bucket([]byte("id"))
+		if byId == nil {
+			return nil
+		}
+		return byId.ForEach(func(id, v []byte) error {
+			if v == nil {
+				counts[string(id)] += int64(byId.Bucket(id).Stats().KeyN)
+			}
+			return nil
+		})
+	}
+
+	return bucket.ForEach(func(k, v []byte) error {
+		msg, err := decodeHeader(v, false)
+		if err != nil {
+			return err
+		}
+		// like the index, logs without an id aren't counted
+		if msg.Id != "" {
+			counts[msg.Id]++
+		}
+		return nil
+	})
+}
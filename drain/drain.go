@@ -3,10 +3,13 @@ package drain
 
 import (
 	"fmt"
+	"io"
 	"net/url"
 	"path/filepath"
 	"strings"
 
+	"github.com/boltdb/bolt"
+
 	"github.com/nanopack/logvac/config"
 	"github.com/nanopack/logvac/core"
 )
@@ -16,8 +19,14 @@ type (
 	ArchiverDrain interface {
 		// Init initializes the archiver drain
 		Init() error
-		// Slice returns a slice of logs based on the name, offset, limit, and log-level
-		Slice(name, host string, tag []string, offset, end, limit int64, level int) ([]logvac.Message, error)
+		// Slice returns a slice of logs matching the query
+		Slice(query Query) ([]logvac.Message, error)
+		// Walk calls fn with each log matching the query, in the order read
+		Walk(query Query, fn func(msg logvac.Message) error) error
+		// Histogram counts the logs matching the query per interval of time
+		Histogram(query Query, interval int64, group string) ([]HistogramBucket, error)
+		// Notify returns a channel that is closed once a log of the type (or types) is written
+		Notify(kind string) <-chan bool
 		// Write writes the message to database
 		Write(msg logvac.Message)
 		// Expire cleans up old logs
@@ -76,12 +85,40 @@ func Init() error {
 }
 
 func archiveInit() error {
-	u, err := url.Parse(config.DbAddress)
+	err := openArchive()
 	if err != nil {
-		u, err = url.Parse("boltdb://" + config.DbAddress)
-		if err != nil {
-			return fmt.Errorf("Failed to parse db connection - %s", err)
-		}
+		return err
+	}
+	// archive logs from logvac
+	err = Archiver.Init()
+	if err != nil {
+		return err
+	}
+	// start cleanup goroutine
+	go Archiver.Expire()
+	return nil
+}
+
+// OpenArchive opens the archive at 'db-address' for commands working on the
+// archive of a stopped logvac. Logs aren't archived from logvac, indexed, or
+// expired, so logvac needn't be initialized.
+func OpenArchive() error {
+	err := openArchive()
+	if err != nil {
+		return err
+	}
+	archive, ok := Archiver.(*BoltArchive)
+	if !ok {
+		return fmt.Errorf("Archive doesn't support opening offline")
+	}
+	return archive.open()
+}
+
+// openArchive creates the archiver for 'db-address'
+func openArchive() error {
+	u, err := dbURL()
+	if err != nil {
+		return err
 	}
 
 	dbDir = filepath.Dir(u.Path)
@@ -109,14 +146,19 @@ func archiveInit() error {
 			return err
 		}
 	}
-	// initialize Archiver
-	err = Archiver.Init()
+	return nil
+}
+
+// dbURL parses 'db-address'
+func dbURL() (*url.URL, error) {
+	u, err := url.Parse(config.DbAddress)
 	if err != nil {
-		return err
+		u, err = url.Parse("boltdb://" + config.DbAddress)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse db connection - %s", err)
+		}
 	}
-	// start cleanup goroutine
-	go Archiver.Expire()
-	return nil
+	return u, nil
 }
 
 func publishInit() error {
@@ -265,6 +307,114 @@ func GetDrain(d logvac.Drain) (*PublisherDrain, error) {
 	return &drain, nil
 }
 
+// Compact reclaims the unused space in the archive.
+func Compact() (*CompactStats, error) {
+	archive, ok := Archiver.(*BoltArchive)
+	if !ok {
+		return nil, fmt.Errorf("Archive doesn't support compacting")
+	}
+	return archive.Compact()
+}
+
+// Stats describes what the archive holds, with the `top` ids logging the most
+// of each type.
+func Stats(top int) (*ArchiveStats, error) {
+	archive, ok := Archiver.(*BoltArchive)
+	if !ok {
+		return nil, fmt.Errorf("Archive doesn't support stats")
+	}
+	return archive.Stats(top)
+}
+
+// Purge deletes the logs matching the query and records what was deleted (see
+// BoltArchive.Purge).
+func Purge(query Query, record PurgeRecord) (*PurgeRecord, error) {
+	archive, ok := Archiver.(*BoltArchive)
+	if !ok {
+		return nil, fmt.Errorf("Archive doesn't support purging")
+	}
+	return archive.Purge(query, record)
+}
+
+// Purges returns the record of each purge, newest first.
+func Purges() ([]PurgeRecord, error) {
+	archive, ok := Archiver.(*BoltArchive)
+	if !ok {
+		return nil, fmt.Errorf("Archive doesn't support purging")
+	}
+	return archive.Purges()
+}
+
+// PlaceHold keeps logs from being expired or purged until the hold is released
+// or expires.
+func PlaceHold(hold Hold) (*Hold, error) {
+	archive, ok := Archiver.(*BoltArchive)
+	if !ok {
+		return nil, fmt.Errorf("Archive doesn't support holds")
+	}
+	return archive.PlaceHold(hold)
+}
+
+// Holds returns every hold placed.
+func Holds() ([]Hold, error) {
+	archive, ok := Archiver.(*BoltArchive)
+	if !ok {
+		return nil, fmt.Errorf("Archive doesn't support holds")
+	}
+	return archive.Holds()
+}
+
+// ReleaseHold removes a hold.
+func ReleaseHold(id string) error {
+	archive, ok := Archiver.(*BoltArchive)
+	if !ok {
+		return fmt.Errorf("Archive doesn't support holds")
+	}
+	return archive.ReleaseHold(id)
+}
+
+// CloseArchive closes the archive.
+func CloseArchive() {
+	if archive, ok := Archiver.(*BoltArchive); ok {
+		archive.Close()
+	}
+}
+
+// Snapshot calls fn with a read transaction on each db file of the archive
+// and the drain config, named as they're restored (see SnapshotPath).
+func Snapshot(fn func(name string, tx *bolt.Tx) error) error {
+	archive, ok := Archiver.(*BoltArchive)
+	if !ok {
+		return fmt.Errorf("Archive doesn't support snapshots")
+	}
+	if err := archive.Snapshot(fn); err != nil {
+		return fmt.Errorf("Failed to snapshot archive - %s", err)
+	}
+	if err := snapshotDrains(fn); err != nil {
+		return fmt.Errorf("Failed to snapshot drain config - %s", err)
+	}
+	return nil
+}
+
+// Dump writes the archived logs matching the query to w as newline delimited
+// json (gzipped if compress is set).
+func Dump(w io.Writer, query Query, compress bool) (int64, error) {
+	archive, ok := Archiver.(*BoltArchive)
+	if !ok {
+		return 0, fmt.Errorf("Archive doesn't support dumping")
+	}
+	return archive.Dump(w, query, compress)
+}
+
+// Restore writes the logs of a dump to the archive.
+func Restore(r io.Reader) (int64, error) {
+	archive, ok := Archiver.(*BoltArchive)
+	if !ok {
+		return 0, fmt.Errorf("Archive doesn't support restoring")
+	}
+	return archive.Restore(r)
+}
+
 // ListDrains shows all the drains configured.
 func ListDrains() map[string]PublisherDrain {
 	return drains
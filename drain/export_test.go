@@ -0,0 +1,7 @@
+package drain
+
+// CompactTxSize lets tests compact in small chunks
+var CompactTxSize = &compactTxSize
+
+// OpenTimeout lets tests wait less for dbs in use
+var OpenTimeout = &openTimeout
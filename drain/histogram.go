@@ -0,0 +1,119 @@
+package drain
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/nanopack/logvac/core"
+)
+
+// HistogramMax is the most intervals a histogram may have
+const HistogramMax = 10000
+
+type (
+	// HistogramBucket is the number of logs in an interval of time
+	HistogramBucket struct {
+		Time   int64            `json:"time"`             // utime the interval starts at
+		Count  int64            `json:"count"`            // number of logs in the interval
+		Groups map[string]int64 `json:"groups,omitempty"` // number of logs of each level, id, or tag (if grouped)
+	}
+
+	// histogram counts logs per interval
+	histogram struct {
+		interval int64
+		group    string // level, id, tag, or "" to not group
+		buckets  map[int64]*HistogramBucket
+	}
+
+	// header is a stored log without its content
+	header struct {
+		UTime    int64    `json:"utime"`
+		Id       string   `json:"id"`
+		Tag      []string `json:"tag"`
+		Type     string   `json:"type"`
+		Priority int      `json:"priority"`
+	}
+)
+
+// ValidGroup returns true if logs can be counted by the group
+func ValidGroup(group string) bool {
+	return group == "" || group == "level" || group == "id" || group == "tag"
+}
+
+func newHistogram(interval int64, group string) *histogram {
+	return &histogram{interval: interval, group: group, buckets: make(map[int64]*HistogramBucket)}
+}
+
+// add counts a log (only its utime is needed if not grouped)
+func (h *histogram) add(utime int64, msg logvac.Message) {
+	start := utime - utime%h.interval
+	if utime%h.interval < 0 {
+		start -= h.interval
+	}
+
+	b, ok := h.buckets[start]
+	if !ok {
+		b = &HistogramBucket{Time: start}
+		if h.group != "" {
+			b.Groups = make(map[string]int64)
+		}
+		h.buckets[start] = b
+	}
+	b.Count++
+
+	switch h.group {
+	case "level":
+		b.Groups[LevelName(msg.Priority)]++
+	case "id":
+		b.Groups[msg.Id]++
+	case "tag":
+		// logs are counted once per tag
+		for i := range msg.Tag {
+			b.Groups[msg.Tag[i]]++
+		}
+	}
+}
+
+// result returns the intervals in time order, including empty intervals between
+// from and to (or the first and last logs counted, if 0)
+func (h *histogram) result(from, to int64) ([]HistogramBucket, error) {
+	if len(h.buckets) == 0 && (from == 0 || to == 0) {
+		return []HistogramBucket{}, nil
+	}
+
+	first, last := from-from%h.interval, to-to%h.interval
+	for start := range h.buckets {
+		if from == 0 && (first == 0 || start < first) {
+			first = start
+		}
+		if to == 0 && start > last {
+			last = start
+		}
+	}
+	if (last-first)/h.interval >= HistogramMax {
+		return nil, fmt.Errorf("Too many intervals (max %d) - use a longer interval", HistogramMax)
+	}
+
+	buckets := make([]HistogramBucket, 0, (last-first)/h.interval+1)
+	for start := first; start <= last; start += h.interval {
+		b, ok := h.buckets[start]
+		if !ok {
+			b = &HistogramBucket{Time: start}
+		}
+		buckets = append(buckets, *b)
+	}
+
+	return buckets, nil
+}
+
+// decodeHeader unmarshals a stored message, skipping its content unless whole
+func decodeHeader(v []byte, whole bool) (logvac.Message, error) {
+	if !whole {
+		h := header{}
+		if json.Unmarshal(v, &h) == nil {
+			return logvac.Message{UTime: h.UTime, Id: h.Id, Tag: h.Tag, Type: h.Type, Priority: h.Priority}, nil
+		}
+		// old messages have a single tag, decode them fully
+	}
+	return decode(v)
+}
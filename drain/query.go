@@ -0,0 +1,207 @@
+package drain
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/nanopack/logvac/core"
+)
+
+type (
+	// Query defines which archived logs to fetch
+	Query struct {
+		Type   string   // type of logs (app|deploy), several types (app,deploy) or all types (*) merged by time
+		Id     []string // only logs from any of these ids (host), "!id" excludes an id and "*" matches any characters
+		Tag    []string // only logs with any of these tags, "!tag" excludes a tag and "*" matches any characters
+		Start  int64    // utime to read logs older than (0 is newest)
+		End    int64    // utime to stop reading at
+		Limit  int64    // number of matching logs to return
+		Level  int      // minimum priority
+		Levels []int    // only logs of these priorities (any if empty)
+
+		Forward bool // read from End towards Start (oldest logs first) rather than from Start towards End
+
+		Predicate func(msg logvac.Message) bool // only logs satisfying this (a compiled query language filter)
+
+		Content    string         // only logs containing this text
+		Regexp     *regexp.Regexp // only logs matching this expression
+		IgnoreCase bool           // match Content case-insensitively
+		ScanLimit  int64          // number of logs to examine before giving up (0 is unlimited)
+	}
+)
+
+// Match returns true if the message satisfies the query's filters
+func (q Query) Match(msg logvac.Message) bool {
+	if msg.Priority < q.Level {
+		return false
+	}
+	if len(q.Levels) != 0 && !matchLevel(msg.Priority, q.Levels) {
+		return false
+	}
+	if len(q.Id) != 0 && !matchId(msg.Id, q.Id) {
+		return false
+	}
+	if len(q.Tag) != 0 && !matchTag(msg.Tag, q.Tag) {
+		return false
+	}
+	if q.Content != "" {
+		if q.IgnoreCase {
+			if !strings.Contains(strings.ToLower(msg.Content), strings.ToLower(q.Content)) {
+				return false
+			}
+		} else if !strings.Contains(msg.Content, q.Content) {
+			return false
+		}
+	}
+	if q.Regexp != nil && !q.Regexp.MatchString(msg.Content) {
+		return false
+	}
+	if q.Predicate != nil && !q.Predicate(msg) {
+		return false
+	}
+	return true
+}
+
+// MatchType returns true if logs of the type are among the query's types
+func (q Query) MatchType(kind string) bool {
+	return matchType(q.Type, kind)
+}
+
+// matchType returns true if the type is among the wanted types ("app",
+// "app,deploy" or "*")
+func matchType(want, kind string) bool {
+	if want == "*" || want == kind {
+		return true
+	}
+	for _, w := range strings.Split(want, ",") {
+		if w == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// matchLevel returns true if the priority is one of the wanted levels
+func matchLevel(priority int, want []int) bool {
+	for i := range want {
+		if want[i] == priority {
+			return true
+		}
+	}
+	return false
+}
+
+// matchId returns true if the id is one of the wanted ids (or none are
+// wanted) and isn't excluded
+func matchId(id string, want []string) bool {
+	included, includes := false, false
+	for i := range want {
+		if strings.HasPrefix(want[i], "!") {
+			if glob(want[i][1:], id) {
+				return false
+			}
+			continue
+		}
+		includes = true
+		if glob(want[i], id) {
+			included = true
+		}
+	}
+	return included || !includes
+}
+
+// matchTag returns true if any of the message's tags is one of the wanted tags
+// (a blank tag matches any, and none wanted matches all) and none are excluded
+func matchTag(tags, want []string) bool {
+	included, includes := false, false
+	for y := range want {
+		if strings.HasPrefix(want[y], "!") {
+			for x := range tags {
+				if glob(want[y][1:], tags[x]) {
+					return false
+				}
+			}
+			continue
+		}
+		includes = true
+		for x := range tags {
+			if want[y] == "" || glob(want[y], tags[x]) {
+				included = true
+			}
+		}
+	}
+	return included || !includes
+}
+
+// glob returns true if s matches the pattern, where "*" matches any characters
+// (other characters, like the brackets of "nginx[access]", match themselves)
+func glob(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i == -1 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// exact returns the filters as exact values, or false if any are excluded or
+// patterns
+func exact(filters []string) ([]string, bool) {
+	for i := range filters {
+		if filters[i] == "" || strings.HasPrefix(filters[i], "!") || strings.Contains(filters[i], "*") {
+			return nil, false
+		}
+	}
+	return filters, len(filters) != 0
+}
+
+// ParseTime parses a time given as a unix epoch (nanoseconds, in decimal) or in
+// RFC3339
+func ParseTime(value string) (int64, error) {
+	if utime, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return utime, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixNano(), nil
+}
+
+// MaxLevel is the highest priority a log has (lumber's fatal)
+const MaxLevel = lumber.FATAL
+
+// LevelName returns the name of a priority ("warn"), or its number if unnamed.
+// Level names are lumber's, so they match what logvac and its clients log with.
+func LevelName(priority int) string {
+	if priority < 0 || priority > MaxLevel {
+		return strconv.Itoa(priority)
+	}
+	return strings.ToLower(strings.TrimSpace(lumber.LvlStr(priority)))
+}
+
+// ParseLevel returns the priority of a level name ("error") or number ("4")
+func ParseLevel(level string) (int, bool) {
+	level = strings.ToLower(strings.TrimSpace(level))
+	for priority := 0; priority <= MaxLevel; priority++ {
+		if LevelName(priority) == level || strconv.Itoa(priority) == level {
+			return priority, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,219 @@
+package drain
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// log-keep maps types (or "*", the default for types not listed) to a policy:
+//
+//   "2w"        keep logs for 2 weeks (X(s)ec, (m)in, (h)our, (d)ay, (w)eek, (y)ear)
+//   10000       keep the newest 10000 logs (also "10000")
+//   {"max_age": "2w", "max_count": 1000000, "max_bytes": "5GB", "levels": {"error": "90d", "debug": "1d"}}
+//
+// Rules are combined (logs are removed once any applies), and `levels`
+// overrides max_age for logs of those levels.
+
+type (
+	// keepPolicy is how long, how many, and how much of a type's logs to keep
+	keepPolicy struct {
+		age    int64         // nanoseconds to keep logs (0 keeps them regardless of age)
+		levels map[int]int64 // nanoseconds to keep logs of a priority (overrides age)
+		count  int64         // number of logs to keep (-1 keeps any number)
+		bytes  int64         // bytes of logs to keep (0 keeps any amount)
+	}
+
+	// keepRules is the json form of a policy
+	keepRules struct {
+		MaxAge   interface{}       `json:"max_age"`
+		MaxCount interface{}       `json:"max_count"`
+		MaxBytes interface{}       `json:"max_bytes"`
+		Levels   map[string]string `json:"levels"`
+	}
+)
+
+// parseLogKeep parses and validates a log-keep setting
+func parseLogKeep(logKeep string) (map[string]*keepPolicy, error) {
+	policies := make(map[string]*keepPolicy)
+	if logKeep == "" {
+		return policies, nil
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(logKeep), &raw); err != nil {
+		return nil, fmt.Errorf("Bad JSON syntax for log-keep - %s", err)
+	}
+
+	for kind, rule := range raw {
+		policy, err := parsePolicy(rule)
+		if err != nil {
+			return nil, fmt.Errorf("Bad log-keep for '%s' - %s", kind, err)
+		}
+		policies[kind] = policy
+	}
+
+	return policies, nil
+}
+
+// parsePolicy parses the policy of a type
+func parsePolicy(rule json.RawMessage) (*keepPolicy, error) {
+	policy := &keepPolicy{count: -1}
+
+	var value interface{}
+	if err := json.Unmarshal(rule, &value); err != nil {
+		return nil, err
+	}
+
+	switch v := value.(type) {
+	case float64, string:
+		// an age or count
+		if age, ok, err := parseAge(v); ok {
+			policy.age = age
+			return policy, err
+		}
+		count, err := parseCount(v)
+		policy.count = count
+		return policy, err
+	case map[string]interface{}:
+		for name := range v {
+			switch name {
+			case "max_age", "max_count", "max_bytes", "levels":
+			default:
+				return nil, fmt.Errorf("Unknown rule '%s' (max_age|max_count|max_bytes|levels)", name)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Must be an age, count, or rules")
+	}
+
+	rules := keepRules{}
+	if err := json.Unmarshal(rule, &rules); err != nil {
+		return nil, fmt.Errorf("Bad rules - %s", err)
+	}
+
+	var err error
+	if rules.MaxAge != nil {
+		age, ok, err := parseAge(rules.MaxAge)
+		if !ok && err == nil {
+			err = fmt.Errorf("Bad max_age '%v'", rules.MaxAge)
+		}
+		if err != nil {
+			return nil, err
+		}
+		policy.age = age
+	}
+	if rules.MaxCount != nil {
+		if policy.count, err = parseCount(rules.MaxCount); err != nil {
+			return nil, err
+		}
+	}
+	if rules.MaxBytes != nil {
+		if policy.bytes, err = parseBytes(rules.MaxBytes); err != nil {
+			return nil, err
+		}
+	}
+	if len(rules.Levels) != 0 {
+		policy.levels = make(map[int]int64)
+		for name, keep := range rules.Levels {
+			priority, ok := ParseLevel(name)
+			if !ok {
+				return nil, fmt.Errorf("Bad level '%s' (trace|debug|info|warn|error|fatal)", name)
+			}
+			age, ok, err := parseAge(keep)
+			if !ok && err == nil {
+				err = fmt.Errorf("Bad age '%s' for level '%s'", keep, name)
+			}
+			if err != nil {
+				return nil, err
+			}
+			policy.levels[priority] = age
+		}
+	}
+
+	return policy, nil
+}
+
+// parseAge parses an age such as "2w", returning false if the value isn't an
+// age (but may be a count)
+func parseAge(value interface{}) (int64, bool, error) {
+	age, ok := value.(string)
+	if !ok || !regexp.MustCompile("^[0-9]+[a-zA-Z]+$").MatchString(age) {
+		return 0, false, nil
+	}
+	period, err := ParsePeriod(age)
+	return period, true, err
+}
+
+// parseCount parses a number of logs (10000 or "10000")
+func parseCount(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case float64:
+		if v < 0 || v != math.Trunc(v) {
+			return 0, fmt.Errorf("Bad count '%v' - must be a whole number", v)
+		}
+		return int64(v), nil
+	case string:
+		count, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || count < 0 {
+			return 0, fmt.Errorf("Bad count '%s' - must be a whole number", v)
+		}
+		return count, nil
+	}
+	return 0, fmt.Errorf("Bad count '%v' - must be a whole number", value)
+}
+
+// parseBytes parses an amount of data (5368709120, "5GB", "500MB")
+func parseBytes(value interface{}) (int64, error) {
+	if v, ok := value.(float64); ok {
+		value = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	size, ok := value.(string)
+	match := regexp.MustCompile(`^([0-9]+)\s*([kKmMgGtT]?[bB]?)$`).FindStringSubmatch(size)
+	if !ok || len(match) != 3 {
+		return 0, fmt.Errorf("Bad size '%v' (X, XKB, XMB, XGB, XTB)", value)
+	}
+	number, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil || number < 1 {
+		return 0, fmt.Errorf("Bad size '%v' - must be greater than 0", value)
+	}
+
+	unit := map[string]int64{
+		"":  1,
+		"K": 1 << 10,
+		"M": 1 << 20,
+		"G": 1 << 30,
+		"T": 1 << 40,
+	}[strings.TrimSuffix(strings.ToUpper(match[2]), "B")]
+
+	return number * unit, nil
+}
+
+// ages returns the shortest and longest age logs are kept for (0 is forever)
+func (p *keepPolicy) ages() (int64, int64) {
+	shortest, longest := p.age, p.age
+	for _, age := range p.levels {
+		if shortest == 0 || age < shortest {
+			shortest = age
+		}
+	}
+	if longest != 0 {
+		for _, age := range p.levels {
+			if age > longest {
+				longest = age
+			}
+		}
+	}
+	return shortest, longest
+}
+
+// ageOf returns the age logs of a priority are kept for (0 is forever)
+func (p *keepPolicy) ageOf(priority int) int64 {
+	if age, ok := p.levels[priority]; ok {
+		return age
+	}
+	return p.age
+}
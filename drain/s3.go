@@ -0,0 +1,234 @@
+package drain
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+type (
+	// s3Client stores objects in an S3-compatible object store (aws, minio)
+	s3Client struct {
+		endpoint string // scheme and host of the object store
+		bucket   string
+		prefix   string // prepended to every key
+		region   string
+		key      string // access key
+		secret   string // secret key
+		client   *http.Client
+	}
+
+	// s3List is the (interesting) part of a ListObjectsV2 response
+	s3List struct {
+		Contents []struct {
+			Key string `xml:"Key"`
+		} `xml:"Contents"`
+		IsTruncated           bool   `xml:"IsTruncated"`
+		NextContinuationToken string `xml:"NextContinuationToken"`
+	}
+)
+
+// newS3Client creates a client from an address such as
+// 's3://key:secret@s3.amazonaws.com/bucket/prefix?region=us-east-1'
+// ('insecure=true' uses http, for a local minio)
+func newS3Client(address string) (*s3Client, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse cold storage address - %s", err)
+	}
+	if u.Scheme != "s3" {
+		return nil, fmt.Errorf("Bad cold storage address - expected 's3://key:secret@host/bucket'")
+	}
+
+	path := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if u.Host == "" || path[0] == "" {
+		return nil, fmt.Errorf("Bad cold storage address - expected 's3://key:secret@host/bucket'")
+	}
+
+	c := &s3Client{
+		endpoint: "https://" + u.Host,
+		bucket:   path[0],
+		region:   u.Query().Get("region"),
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}
+	if len(path) == 2 && path[1] != "" {
+		c.prefix = path[1] + "/"
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if u.Query().Get("insecure") == "true" {
+		c.endpoint = "http://" + u.Host
+	}
+	if u.User != nil {
+		c.key = u.User.Username()
+		c.secret, _ = u.User.Password()
+	}
+
+	return c, nil
+}
+
+// put stores an object
+func (c *s3Client) put(key string, body []byte) error {
+	res, err := c.do("PUT", "/"+c.bucket+"/"+c.prefix+key, nil, body)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// get fetches an object
+func (c *s3Client) get(key string) ([]byte, error) {
+	res, err := c.do("GET", "/"+c.bucket+"/"+c.prefix+key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+// delete removes an object
+func (c *s3Client) delete(key string) error {
+	res, err := c.do("DELETE", "/"+c.bucket+"/"+c.prefix+key, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// list returns the keys (without the client's prefix) of the objects starting
+// with prefix, in order
+func (c *s3Client) list(prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {c.prefix + prefix}}
+	for {
+		res, err := c.do("GET", "/"+c.bucket, query, nil)
+		if err != nil {
+			return nil, err
+		}
+		list := s3List{}
+		err = xml.NewDecoder(res.Body).Decode(&list)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Bad object list - %s", err)
+		}
+
+		for i := range list.Contents {
+			keys = append(keys, strings.TrimPrefix(list.Contents[i].Key, c.prefix))
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", list.NextContinuationToken)
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// do sends a signed request, returning an error unless it succeeded
+func (c *s3Client) do(method, path string, query url.Values, body []byte) (*http.Response, error) {
+	target := c.endpoint + s3Escape(path, true)
+	if len(query) != 0 {
+		target += "?" + s3Query(query)
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, body, time.Now().UTC())
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("%s %s failed - %s %s", method, path, res.Status, msg)
+	}
+	return res, nil
+}
+
+// sign adds an aws signature (version 4) to the request
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("x-amz-date", amzDate)
+
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		s3Query(req.URL.Query()),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signed,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secret), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.key, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes a value the way aws signatures expect (slashes are kept in
+// paths)
+func s3Escape(value string, path bool) string {
+	escaped := &bytes.Buffer{}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			escaped.WriteByte(c)
+		case c == '/' && path:
+			escaped.WriteByte(c)
+		default:
+			fmt.Fprintf(escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// s3Query encodes a query string the way aws signatures expect (sorted)
+func s3Query(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
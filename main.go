@@ -12,23 +12,40 @@
 //
 //  Available Commands:
 //    add-token   Add http publish/subscribe authentication token
+//    archive     Dump or restore the log archive of a stopped logvac
+//    compact     Reclaim unused space in a running logvac's log archive
 //    export      Export http publish/subscribe authentication tokens
 //    import      Import http publish/subscribe authentication tokens
 //
 //  Flags:
 //    -A, --auth-address string   Address or file location of authentication db. ('boltdb:///var/db/logvac.bolt' or 'postgresql://127.0.0.1') (default "boltdb:///var/db/log-auth.bolt")
+//        --cold-address string   S3-compatible storage to offload logs to before expiring them ('s3://key:secret@host/bucket/prefix?region=us-east-1')
 //    -c, --config-file string    config file location for server
 //    -C, --cors-allow string     Sets the 'Access-Control-Allow-Origin' header (default "*")
 //    -d, --db-address string     Log storage address (default "boltdb:///var/db/logvac.bolt")
+//        --dedup-window int      Window (seconds) within which identical messages from a source are collapsed (0 disables)
 //    -i, --insecure              Don't use TLS (used for testing)
 //    -a, --listen-http string    API listen address (same endpoint for http log collection) (default "127.0.0.1:6360")
 //    -t, --listen-tcp string     TCP log collection endpoint (default "127.0.0.1:6361")
 //    -u, --listen-udp string     UDP log collection endpoint (default "127.0.0.1:514")
-//    -k, --log-keep string       Age or number of logs to keep per type '{"app":"2w", "deploy": 10}' (int or X(m)in, (h)our,  (d)ay, (w)eek, (y)ear) (default "{\"app\":\"2w\"}")
+//    -k, --log-keep string       Age or number of logs to keep per type '{"app":"2w", "deploy": 10}' (int or X(m)in, (h)our,  (d)ay, (w)eek, (y)ear, or rules; see README) (default "{\"app\":\"2w\"}")
 //    -l, --log-level string      Level at which to log (default "info")
 //    -L, --log-type string       Default type to apply to incoming logs (commonly used: app|deploy) (default "app")
+//        --max-size int          Max size (bytes) of a message's content (0 is unlimited)
+//        --max-size-http int     Max message size for the http collector (overrides max-size)
+//        --max-size-tcp int      Max message size for the tcp collector (overrides max-size)
+//        --max-size-udp int      Max message size for the udp collector (overrides max-size)
+//        --oversize-action string What to do with messages over the max size (truncate|reject) (default "truncate")
+//        --partition string      Period of time each archive file holds per type (X(m)in, (h)our, (d)ay, (w)eek) ('' archives to a single file) (default "1d")
 //    -p, --pub-address string    Log publisher (mist) address ("mist://127.0.0.1:1445")
 //    -P, --pub-auth string       Log publisher (mist) auth token
+//        --rate-limit string     Per id|token|type limits '[{"by":"id", "rate":100, "burst":500, "action":"drop"}]' (action: drop|sample|downgrade)
+//        --rate-limit-report int How often (seconds) to log a summary of rate limited messages (default 60)
+//        --redact string         Regex rules to redact from logs before storing/draining '{"password":"password=(\\S+)"}'
+//        --redact-builtin string Built-in redaction detectors to enable (credit-card,bearer-token,aws-key)
+//        --redact-mask string    Replacement text for redacted data (default "[REDACTED]")
+//        --restore-backup string Backup (from /admin/backup) to replace the archive, drain config, and auth dbs with before starting
+//        --scan-limit int        Max logs examined per request when fetching logs (0 is unlimited) (default 1000000)
 //    -s, --server                Run as server
 //    -T, --token string          Administrative token to add/remove 'X-USER-TOKEN's used to pub/sub via http (default "secret")
 //    -v, --version               Print version info and exit
@@ -36,11 +53,18 @@
 package main
 
 import (
+	"archive/tar"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
 	"syscall"
+	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/jcelliott/lumber"
 	"github.com/spf13/cobra"
 
@@ -56,6 +80,10 @@ var (
 	configFile string
 	portFile   string
 	tokenName  string
+	dumpType   string
+	dumpFrom   string
+	dumpTo     string
+	dumpGzip   bool
 
 	exportCommand = &cobra.Command{
 		Use:   "export",
@@ -73,6 +101,36 @@ var (
 		RunE: importLogvac,
 	}
 
+	compactCommand = &cobra.Command{
+		Use:   "compact",
+		Short: "Reclaim unused space in a running logvac's log archive",
+		Long:  ``,
+
+		RunE: compactLogvac,
+	}
+
+	archiveCommand = &cobra.Command{
+		Use:   "archive",
+		Short: "Dump or restore the log archive of a stopped logvac",
+		Long:  ``,
+	}
+
+	dumpCommand = &cobra.Command{
+		Use:   "dump",
+		Short: "Dump archived logs as newline delimited json",
+		Long:  ``,
+
+		RunE: dumpArchive,
+	}
+
+	restoreCommand = &cobra.Command{
+		Use:   "restore",
+		Short: "Restore archived logs from a dump",
+		Long:  ``,
+
+		RunE: restoreArchive,
+	}
+
 	addKeyCommand = &cobra.Command{
 		Use:   "add-token",
 		Short: "Add http publish/subscribe authentication token",
@@ -104,11 +162,25 @@ func main() {
 	Logvac.AddCommand(exportCommand)
 	Logvac.AddCommand(importCommand)
 	Logvac.AddCommand(addKeyCommand)
+	Logvac.AddCommand(compactCommand)
+	Logvac.AddCommand(archiveCommand)
+	archiveCommand.AddCommand(dumpCommand)
+	archiveCommand.AddCommand(restoreCommand)
 
 	config.AddFlags(Logvac)
 	exportCommand.Flags().StringVarP(&portFile, "file", "f", "", "Export file location")
 	importCommand.Flags().StringVarP(&portFile, "file", "f", "", "Import file location")
 	addKeyCommand.Flags().StringVarP(&tokenName, "token", "t", "", "Authentication token for http publish/subscribe")
+	compactCommand.Flags().StringVarP(&config.ListenHttp, "listen-http", "a", config.ListenHttp, "API address of the running logvac")
+	compactCommand.Flags().StringVarP(&config.Token, "token", "T", config.Token, "Administrative token of the running logvac")
+	compactCommand.Flags().BoolVarP(&config.Insecure, "insecure", "i", config.Insecure, "Running logvac doesn't use TLS")
+	archiveCommand.PersistentFlags().StringVarP(&config.DbAddress, "db-address", "d", config.DbAddress, "Log storage address")
+	archiveCommand.PersistentFlags().StringVarP(&portFile, "file", "f", "", "Dump file location (stdin/stdout if unset)")
+	dumpCommand.Flags().StringVarP(&dumpType, "type", "L", "*", "Types of logs to dump (comma separated, '*' for all)")
+	dumpCommand.Flags().StringVar(&dumpFrom, "from", "", "Dump logs from this time (RFC3339 or unix nanoseconds)")
+	dumpCommand.Flags().StringVar(&dumpTo, "to", "", "Dump logs up to this time (RFC3339 or unix nanoseconds)")
+	dumpCommand.Flags().BoolVarP(&dumpGzip, "gzip", "z", false, "Gzip the dump")
+	restoreCommand.Flags().StringVar(&config.Partition, "partition", config.Partition, "Period of time each archive file holds per type (X(m)in, (h)our, (d)ay, (w)eek) ('' archives to a single file)")
 
 	err := Logvac.Execute()
 	if err != nil && err.Error() != "" {
@@ -142,10 +214,21 @@ func startLogvac(ccmd *cobra.Command, args []string) error {
 	config.Log = lumber.NewConsoleLogger(lumber.LvlInt(config.LogLevel))
 
 	// initialize logvac
-	logvac.Init()
+	err := logvac.Init()
+	if err != nil {
+		return fmt.Errorf("Logvac failed to initialize - %s", err)
+	}
+
+	// restore a backup before opening the dbs it replaces
+	if config.RestoreBackup != "" {
+		err = restoreBackup(config.RestoreBackup)
+		if err != nil {
+			return fmt.Errorf("Failed to restore backup - %s", err)
+		}
+	}
 
 	// setup authenticator
-	err := authenticator.Init()
+	err = authenticator.Init()
 	if err != nil {
 		return fmt.Errorf("Authenticator failed to initialize - %s", err)
 	}
@@ -231,3 +314,231 @@ func addKey(ccmd *cobra.Command, args []string) error {
 
 	return nil
 }
+
+func compactLogvac(ccmd *cobra.Command, args []string) error {
+	scheme := "https"
+	if config.Insecure {
+		scheme = "http"
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s://%s/admin/compact", scheme, config.ListenHttp), nil)
+	if err != nil {
+		return fmt.Errorf("Failed to create request - %s", err)
+	}
+	req.Header.Set("X-AUTH-TOKEN", config.Token)
+
+	// logvac generates its own certificate
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to reach logvac - %s", err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("Failed to read response - %s", err)
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("Failed to compact - %s %s", res.Status, body)
+	}
+
+	fmt.Printf("%s", body)
+	return nil
+}
+
+func dumpArchive(ccmd *cobra.Command, args []string) error {
+	query := drain.Query{Type: dumpType}
+	var err error
+	if dumpFrom != "" {
+		if query.End, err = drain.ParseTime(dumpFrom); err != nil {
+			return fmt.Errorf("Bad from time - %s", err)
+		}
+	}
+	if dumpTo != "" {
+		if query.Start, err = drain.ParseTime(dumpTo); err != nil {
+			return fmt.Errorf("Bad to time - %s", err)
+		}
+	}
+
+	err = drain.OpenArchive()
+	if err != nil {
+		return fmt.Errorf("Archive failed to initialize - %s", err)
+	}
+	defer drain.CloseArchive()
+
+	var dumpWriter io.Writer
+	if portFile != "" {
+		file, err := os.Create(portFile)
+		if err != nil {
+			return fmt.Errorf("Failed to open file - %s", err)
+		}
+		defer file.Close()
+		dumpWriter = file
+	} else {
+		dumpWriter = os.NewFile(uintptr(syscall.Stdout), "/dev/stdout") // stdout
+	}
+
+	dumped, err := drain.Dump(dumpWriter, query, dumpGzip)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Dumped %d logs\n", dumped)
+	return nil
+}
+
+func restoreArchive(ccmd *cobra.Command, args []string) error {
+	err := drain.OpenArchive()
+	if err != nil {
+		return fmt.Errorf("Archive failed to initialize - %s", err)
+	}
+	defer drain.CloseArchive()
+
+	var restoreReader io.Reader
+	if portFile != "" {
+		file, err := os.Open(portFile)
+		if err != nil {
+			return fmt.Errorf("Failed to open file - %s", err)
+		}
+		defer file.Close()
+		restoreReader = file
+	} else {
+		restoreReader = os.NewFile(uintptr(syscall.Stdin), "/dev/stdin") // stdin
+	}
+
+	restored, err := drain.Restore(restoreReader)
+	fmt.Fprintf(os.Stderr, "Restored %d logs\n", restored)
+	return err
+}
+
+// restoreBackup replaces the archive, drain config, and auth dbs with those of
+// a backup (see /admin/backup). Nothing is replaced unless every db of the
+// backup reads, and a backup is only restored once (see restoreMarker).
+func restoreBackup(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed to open file - %s", err)
+	}
+	defer file.Close()
+
+	marker, restored, err := restoreMarker(file)
+	if err != nil {
+		return err
+	}
+	if current, _ := ioutil.ReadFile(marker); string(current) == restored {
+		config.Log.Info("Backup '%s' already restored, skipping (remove '%s' to restore it again)", path, marker)
+		return nil
+	}
+
+	// extract every db beside the one it replaces before replacing any
+	extracted := map[string]string{} // where each db is restored to, by where it was extracted
+	clean := func() {
+		for tmp := range extracted {
+			os.Remove(tmp)
+		}
+	}
+	var archive bool
+	backup := tar.NewReader(file)
+	for {
+		header, err := backup.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			clean()
+			return fmt.Errorf("Failed to read backup - %s", err)
+		}
+
+		var dest string
+		switch header.Name {
+		case "auth.bolt":
+			dest, err = authenticator.SnapshotPath()
+		default:
+			dest, err = drain.SnapshotPath(header.Name)
+		}
+		if err != nil {
+			clean()
+			return err
+		}
+		if dest == "" {
+			config.Log.Warn("Skipping '%s' - nowhere to restore it to", header.Name)
+			continue
+		}
+
+		tmp := dest + ".restore"
+		extracted[tmp] = dest
+		if err = extractFile(tmp, backup); err != nil {
+			clean()
+			return fmt.Errorf("Failed to extract '%s' - %s", header.Name, err)
+		}
+		if header.Name == "archive.bolt" {
+			archive = true
+		}
+	}
+
+	// partitions of the old archive would otherwise be mixed in
+	if archive {
+		if err = drain.RemoveArchive(); err != nil {
+			clean()
+			return fmt.Errorf("Failed to remove old archive - %s", err)
+		}
+	}
+	for tmp, dest := range extracted {
+		if err = os.Rename(tmp, dest); err != nil {
+			clean()
+			return fmt.Errorf("Failed to restore '%s' - %s", dest, err)
+		}
+		delete(extracted, tmp)
+		config.Log.Info("Restored '%s'", dest)
+	}
+
+	if err = ioutil.WriteFile(marker, []byte(restored), 0644); err != nil {
+		return fmt.Errorf("Failed to mark backup restored - %s", err)
+	}
+	return nil
+}
+
+// restoreMarker returns the file marking which backup was last restored (beside
+// the archive), and what it holds once the backup is restored
+func restoreMarker(backup *os.File) (string, string, error) {
+	info, err := backup.Stat()
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to read file - %s", err)
+	}
+	path, err := filepath.Abs(backup.Name())
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to read file - %s", err)
+	}
+	archive, err := drain.SnapshotPath("archive.bolt")
+	if err != nil {
+		return "", "", err
+	}
+	return archive + ".restored", fmt.Sprintf("%s %d %d\n", path, info.Size(), info.ModTime().UnixNano()), nil
+}
+
+// extractFile writes the bolt db read from r to path, making sure it reads
+func extractFile(path string, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	db, err := bolt.Open(path, 0644, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
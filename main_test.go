@@ -0,0 +1,210 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/jcelliott/lumber"
+
+	"github.com/nanopack/logvac/config"
+	"github.com/nanopack/logvac/core"
+	"github.com/nanopack/logvac/drain"
+)
+
+// test dumping and restoring archives, which is done without starting logvac
+func TestDumpRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logvac-archive")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	config.Log = lumber.NewConsoleLogger(lumber.LvlInt("ERROR"))
+
+	// logvac isn't initialized, as the commands run apart from it
+	config.DbAddress = "boltdb://" + filepath.Join(dir, "dumped.bolt")
+	if err = drain.OpenArchive(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	now := time.Now().UnixNano()
+	for i := 0; i < 10; i++ {
+		drain.Archiver.Write(logvac.Message{
+			Time:     time.Now(),
+			UTime:    now + int64(i),
+			Id:       "myhost",
+			Type:     "app",
+			Priority: 2,
+			Content:  "dump me",
+		})
+	}
+	drain.CloseArchive()
+
+	portFile = filepath.Join(dir, "dump.ndjson")
+	dumpType = "*"
+	if err = dumpArchive(nil, nil); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	config.DbAddress = "boltdb://" + filepath.Join(dir, "restored.bolt")
+	if err = restoreArchive(nil, nil); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if err = drain.OpenArchive(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer drain.CloseArchive()
+	msgs, err := drain.Archiver.Slice(drain.Query{Type: "app", Limit: 100})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msgs) != 10 || msgs[0].UTime != now || msgs[0].Content != "dump me" {
+		t.Errorf("Restored logs don't match dumped - %+v", msgs)
+	}
+}
+
+// test restoring a backup only once it all reads, and only once
+func TestRestoreBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logvac-backup")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	config.Log = lumber.NewConsoleLogger(lumber.LvlInt("ERROR"))
+	config.DbAddress = "boltdb://" + filepath.Join(dir, "logvac.bolt")
+	config.AuthAddress = "boltdb://" + filepath.Join(dir, "auth.bolt")
+
+	oldPart := filepath.Join(dir, "logvac.partitions", "app", "1-2.bolt")
+	for _, path := range []string{filepath.Join(dir, "logvac.bolt"), oldPart} {
+		if err = makeDB(path, "old"); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	newDB := filepath.Join(dir, "new.bolt")
+	if err = makeDB(newDB, "new"); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	fresh, err := ioutil.ReadFile(newDB)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// a backup with a bad db replaces nothing
+	bad := filepath.Join(dir, "bad.tar")
+	if err = makeBackup(bad, map[string][]byte{"archive.bolt": fresh, "drains.bolt": []byte("not a db")}); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if err = restoreBackup(bad); err == nil {
+		t.Error("Restored a bad backup")
+	}
+	if !hasBucket(filepath.Join(dir, "logvac.bolt"), "old") || !hasBucket(oldPart, "old") {
+		t.Error("Bad backup replaced the archive")
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "*.restore")); len(left) != 0 {
+		t.Errorf("Bad backup left %v", left)
+	}
+
+	good := filepath.Join(dir, "good.tar")
+	if err = makeBackup(good, map[string][]byte{"archive.bolt": fresh, "auth.bolt": fresh}); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if err = restoreBackup(good); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if !hasBucket(filepath.Join(dir, "logvac.bolt"), "new") || !hasBucket(filepath.Join(dir, "auth.bolt"), "new") {
+		t.Error("Backup wasn't restored")
+	}
+	if _, err = os.Stat(oldPart); !os.IsNotExist(err) {
+		t.Error("Old archive partitions were left")
+	}
+
+	// starting again doesn't restore the backup over newer logs
+	os.Remove(filepath.Join(dir, "logvac.bolt"))
+	if err = makeDB(filepath.Join(dir, "logvac.bolt"), "newer"); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if err = restoreBackup(good); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if !hasBucket(filepath.Join(dir, "logvac.bolt"), "newer") {
+		t.Error("Backup was restored again")
+	}
+}
+
+// makeDB creates a bolt db at path holding the bucket
+func makeDB(path, bucket string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte(bucket))
+		return err
+	})
+}
+
+// hasBucket returns true if the bolt db at path holds the bucket
+func hasBucket(path, bucket string) bool {
+	db, err := bolt.Open(path, 0644, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	found := false
+	db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket([]byte(bucket)) != nil
+		return nil
+	})
+	return found
+}
+
+// makeBackup writes a backup tar of the named files to path
+func makeBackup(path string, files map[string][]byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	backup := tar.NewWriter(file)
+	// the archive comes first, as in /admin/backup
+	names := []string{"archive.bolt"}
+	for name := range files {
+		if name != "archive.bolt" {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		err = backup.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name]))})
+		if err != nil {
+			return err
+		}
+		if _, err = backup.Write(files[name]); err != nil {
+			return err
+		}
+	}
+	return backup.Close()
+}